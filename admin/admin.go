@@ -0,0 +1,172 @@
+// Package admin serves a JSON API to inspect and control the autoscaler
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/autoscaler"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+)
+
+// Autoscaler is the part of autoscaler.Autoscaler used by the API
+type Autoscaler interface {
+	Pools(ctx context.Context) ([]autoscaler.PoolStatus, error)
+	ListRunners(ctx context.Context, pool string) ([]interfaces.Runner, error)
+	SetPaused(pool string, paused bool) error
+	SetTargetIdle(pool string, targetIdle int) error
+	Prepare(pool string) error
+	DeleteRunner(ctx context.Context, pool, id string) error
+}
+
+// ConfigFunc returns the current config with secrets removed
+type ConfigFunc func() (any, error)
+
+type Handler struct {
+	autoscaler Autoscaler
+	config     ConfigFunc
+	token      []byte
+	mux        *http.ServeMux
+}
+
+// NewHandler creates the API handler. Every request must have an
+// Authorization header with token as a bearer token.
+func NewHandler(autoscaler Autoscaler, config ConfigFunc, token string) *Handler {
+	h := &Handler{
+		autoscaler: autoscaler,
+		config:     config,
+		token:      []byte(token),
+		mux:        http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /api/v1/config", h.getConfig)
+	h.mux.HandleFunc("GET /api/v1/pools", h.listPools)
+	h.mux.HandleFunc("GET /api/v1/pools/{pool}/runners", h.listRunners)
+	h.mux.HandleFunc("DELETE /api/v1/pools/{pool}/runners/{id}", h.deleteRunner)
+	h.mux.HandleFunc("POST /api/v1/pools/{pool}/pause", h.setPaused(true))
+	h.mux.HandleFunc("POST /api/v1/pools/{pool}/resume", h.setPaused(false))
+	h.mux.HandleFunc("PUT /api/v1/pools/{pool}/target-idle", h.setTargetIdle)
+	h.mux.HandleFunc("POST /api/v1/pools/{pool}/prepare", h.prepare)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), h.token) != 1 {
+		writeError(w, http.StatusUnauthorized, errors.New("invalid bearer token"))
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) getConfig(w http.ResponseWriter, r *http.Request) {
+	config, err := h.config()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, config)
+}
+
+func (h *Handler) listPools(w http.ResponseWriter, r *http.Request) {
+	pools, err := h.autoscaler.Pools(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, pools)
+}
+
+func (h *Handler) listRunners(w http.ResponseWriter, r *http.Request) {
+	runners, err := h.autoscaler.ListRunners(r.Context(), r.PathValue("pool"))
+	if err != nil {
+		writeError(w, statusForError(err, http.StatusBadGateway), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, runners)
+}
+
+func (h *Handler) deleteRunner(w http.ResponseWriter, r *http.Request) {
+	pool, id := r.PathValue("pool"), r.PathValue("id")
+	slog.Info("deleting runner from admin api", "pool", pool, "instance", id)
+	err := h.autoscaler.DeleteRunner(r.Context(), pool, id)
+	if err != nil {
+		writeError(w, statusForError(err, http.StatusBadGateway), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) setPaused(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := h.autoscaler.SetPaused(r.PathValue("pool"), paused)
+		if err != nil {
+			writeError(w, statusForError(err, http.StatusInternalServerError), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type targetIdleRequest struct {
+	TargetIdle *int `json:"target_idle"`
+}
+
+func (h *Handler) setTargetIdle(w http.ResponseWriter, r *http.Request) {
+	var req targetIdleRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.TargetIdle == nil {
+		writeError(w, http.StatusBadRequest, errors.New("target_idle must be set"))
+		return
+	}
+	err = h.autoscaler.SetTargetIdle(r.PathValue("pool"), *req.TargetIdle)
+	if err != nil {
+		writeError(w, statusForError(err, http.StatusBadRequest), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) prepare(w http.ResponseWriter, r *http.Request) {
+	err := h.autoscaler.Prepare(r.PathValue("pool"))
+	if err != nil {
+		writeError(w, statusForError(err, http.StatusInternalServerError), err)
+		return
+	}
+	// the image is prepared by the autoscale loop
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// statusForError returns 404 for unknown pools and runners and fallback
+// otherwise
+func statusForError(err error, fallback int) int {
+	if errors.Is(err, autoscaler.ErrPoolNotFound) || errors.Is(err, interfaces.ErrRunnerNotFound) {
+		return http.StatusNotFound
+	}
+	return fallback
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Warn("error when writing admin api response", "error", err)
+	}
+}
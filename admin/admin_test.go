@@ -0,0 +1,110 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/autoscaler"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/fake"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/stretchr/testify.v1/require"
+)
+
+const testToken = "secret"
+
+func newTestHandler(t *testing.T) (*Handler, *autoscaler.Autoscaler, string) {
+	provider := fake.New(fake.Options{})
+	id, err := provider.CreateRunner(context.Background(), "", "", "")
+	require.NoError(t, err)
+	a := autoscaler.New(fake.TokenProvider{}, autoscaler.AutoscalerConfig{
+		Pools: []autoscaler.PoolConfig{{
+			Name:       "build",
+			Provider:   provider,
+			Labels:     "self-hosted,build",
+			TargetIdle: 1,
+			MaxTotal:   4,
+		}},
+		Registerer: prometheus.NewRegistry(),
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	config := func() (any, error) {
+		return map[string]any{"admin": map[string]any{"token": "REDACTED"}}, nil
+	}
+	return NewHandler(a, config, testToken), a, id
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "missing token", method: "GET", path: "/api/v1/pools", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", method: "GET", path: "/api/v1/pools", token: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "config", method: "GET", path: "/api/v1/config", token: testToken, wantStatus: http.StatusOK, wantBody: "REDACTED"},
+		{name: "pools", method: "GET", path: "/api/v1/pools", token: testToken, wantStatus: http.StatusOK, wantBody: `"name":"build"`},
+		{name: "runners", method: "GET", path: "/api/v1/pools/build/runners", token: testToken, wantStatus: http.StatusOK},
+		{name: "runners of unknown pool", method: "GET", path: "/api/v1/pools/other/runners", token: testToken, wantStatus: http.StatusNotFound},
+		{name: "delete unknown runner", method: "DELETE", path: "/api/v1/pools/build/runners/database", token: testToken, wantStatus: http.StatusNotFound},
+		{name: "pause", method: "POST", path: "/api/v1/pools/build/pause", token: testToken, wantStatus: http.StatusNoContent},
+		{name: "pause unknown pool", method: "POST", path: "/api/v1/pools/other/pause", token: testToken, wantStatus: http.StatusNotFound},
+		{name: "target idle", method: "PUT", path: "/api/v1/pools/build/target-idle", token: testToken, body: `{"target_idle":3}`, wantStatus: http.StatusNoContent},
+		{name: "target idle missing", method: "PUT", path: "/api/v1/pools/build/target-idle", token: testToken, body: `{}`, wantStatus: http.StatusBadRequest},
+		{name: "target idle above max total", method: "PUT", path: "/api/v1/pools/build/target-idle", token: testToken, body: `{"target_idle":5}`, wantStatus: http.StatusBadRequest, wantBody: "max total"},
+		{name: "prepare", method: "POST", path: "/api/v1/pools/build/prepare", token: testToken, wantStatus: http.StatusAccepted},
+		{name: "unknown route", method: "GET", path: "/api/v1/unknown", token: testToken, wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _, _ := newTestHandler(t)
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			require.Equal(t, tt.wantStatus, rec.Code, rec.Body.String())
+			require.Contains(t, rec.Body.String(), tt.wantBody)
+		})
+	}
+}
+
+func TestDeleteRunner(t *testing.T) {
+	h, a, id := newTestHandler(t)
+	req := httptest.NewRequest("DELETE", "/api/v1/pools/build/runners/"+id, nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+
+	runners, err := a.ListRunners(context.Background(), "build")
+	require.NoError(t, err)
+	require.Empty(t, runners)
+}
+
+func TestListPools(t *testing.T) {
+	h, _, _ := newTestHandler(t)
+	req := httptest.NewRequest("GET", "/api/v1/pools", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var pools []autoscaler.PoolStatus
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&pools))
+	require.Len(t, pools, 1)
+	require.Equal(t, []string{"self-hosted", "build"}, pools[0].Labels)
+	require.Equal(t, 1, pools[0].Idle)
+	require.Equal(t, 1, pools[0].Total)
+}
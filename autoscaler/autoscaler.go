@@ -2,140 +2,323 @@ package autoscaler
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/journal"
 	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/tracing"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	metricsNamespace = "actions_runner_autoscaler"
-	maximumImageAge  = time.Hour * 24
+	metricsNamespace   = "actions_runner_autoscaler"
+	defaultMaxImageAge = time.Hour * 24
 )
 
-var (
-	totalRunners = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: metricsNamespace,
-		Name:      "total",
-		Help:      "Total number of GitHub Actions runners",
-	})
-	startingRunners = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: metricsNamespace,
-		Name:      "starting",
-		Help:      "Number of GitHub Actions runners in starting state",
-	})
-	idleRunners = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: metricsNamespace,
-		Name:      "idle",
-		Help:      "Number of GitHub Actions runners in idle state",
-	})
-	activeRunners = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: metricsNamespace,
-		Name:      "active",
-		Help:      "Number of GitHub Actions runners in active state",
-	})
-	preparingRunners = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: metricsNamespace,
-		Name:      "preparing",
-		Help:      "Number of instances running for image preparation",
-	})
-)
+var tracer = otel.Tracer("github.com/gartnera/actions-runner-ephemeral-autoscaler/autoscaler")
 
-type AutoscalerConfig struct {
-	TargetIdle     int
-	Labels         string
+var ErrPoolNotFound = errors.New("pool not found")
+
+// PoolConfig configures a set of runners with the same labels created by a
+// single provider
+type PoolConfig struct {
+	// Name identifies the pool in logs and metrics
+	Name     string
+	Provider interfaces.Provider
+	// ProviderName identifies the type of provider in logs
+	ProviderName string
+	TargetIdle   int
+	Labels       string
+	// Arch is the architecture label which every runner of the pool has in
+	// addition to Labels
+	Arch           string
 	PrepareOptions interfaces.PrepareOptions
+
+	// MaxTotal is the maximum number of runners in any state (0 is unlimited)
+	MaxTotal int
+	// MaxStarting is the maximum number of runners starting at once (0 is unlimited)
+	MaxStarting int
+	// MaxCreatePerTick is the maximum number of runners created by a single
+	// Autoscale call (0 is unlimited)
+	MaxCreatePerTick int
+	// CreateConcurrency is how many runners may be created in parallel
+	CreateConcurrency int
+
+	// StartingTimeout is how long a runner may be starting before it is
+	// considered failed and deleted (0 disables)
+	StartingTimeout time.Duration
+	// MaxActiveDuration is how long a runner may be running a job before it
+	// is forcibly deleted (0 disables)
+	MaxActiveDuration time.Duration
+
+	// ScaleDownDelay is how long there must be more idle runners than needed
+	// before the surplus is deleted
+	ScaleDownDelay time.Duration
+
+	// CreateBreakerThreshold is the number of consecutive creation failures
+	// which stop runners from being created (0 disables)
+	CreateBreakerThreshold int
+	// CreateBreakerCooldown is how long creation is stopped before a single
+	// runner is created to probe whether creation works again
+	CreateBreakerCooldown time.Duration
+}
+
+type AutoscalerConfig struct {
+	Pools []PoolConfig
+
+	// DemandProvider is optional. When set, a runner is created for every
+	// pending job in addition to TargetIdle.
+	DemandProvider DemandProvider
+
+	// RunnerRegistry is optional. When set, GitHub decides whether runners
+	// are idle or active and mismatches between instances and registered
+	// runners are reported.
+	RunnerRegistry RunnerRegistry
+
+	// Journal is optional. When set, runner lifecycle events are recorded.
+	Journal *journal.Journal
+
+	// MaxImageAge is how old an image may be before a new one is prepared.
+	// It defaults to 24 hours.
+	MaxImageAge time.Duration
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+	// Registerer registers the metrics. It defaults to
+	// prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+	// Logger defaults to slog.Default()
+	Logger *slog.Logger
 }
 
 type RunnerTokenProvider interface {
 	URL() string
 	Token(context.Context) (string, error)
+	// RemoveRunner deregisters a runner by name
+	RemoveRunner(ctx context.Context, name string) error
 }
 
-type Autoscaler struct {
-	provider      interfaces.Provider
-	tokenProvider RunnerTokenProvider
-	config        AutoscalerConfig
+type DemandProvider interface {
+	// PendingJobs returns the number of queued jobs for each pool of runners
+	// with the provided labels. A job which could run in several pools is
+	// only counted for one of them.
+	PendingJobs(ctx context.Context, poolLabels [][]string) ([]int, error)
 }
 
-func New(provider interfaces.Provider, tokenProvider RunnerTokenProvider, config AutoscalerConfig) *Autoscaler {
-	return &Autoscaler{
-		provider:      provider,
-		config:        config,
-		tokenProvider: tokenProvider,
-	}
+// RunnerRegistry lists the runners registered with GitHub
+type RunnerRegistry interface {
+	RegisteredRunners(ctx context.Context) ([]interfaces.RegisteredRunner, error)
 }
 
-func updateMetrics(metrics interfaces.RunnerDispositionMetrics) {
-	totalRunners.Set(float64(metrics.TotalCount()))
-	startingRunners.Set(float64(metrics.StartingCount()))
-	idleRunners.Set(float64(metrics.IdleCount()))
-	activeRunners.Set(float64(metrics.ActiveCount()))
+type Autoscaler struct {
+	tokenProvider  RunnerTokenProvider
+	demandProvider DemandProvider
+	registrations  *registrationCache
+	journal        *journal.Journal
+	maxImageAge    time.Duration
+	now            func() time.Time
+	metrics        *metrics
+	logger         *slog.Logger
+	// drainInterval is how often Drain checks for active runners
+	drainInterval time.Duration
+
+	// mu guards pools which may be read by the admin API
+	mu    sync.RWMutex
+	pools []*pool
 }
 
-func (a *Autoscaler) maybePrepare(ctx context.Context) error {
-	createdAt, err := a.provider.ImageCreatedAt(ctx)
-	if err != nil {
-		return fmt.Errorf("get image created at: %w", err)
+func New(tokenProvider RunnerTokenProvider, config AutoscalerConfig) *Autoscaler {
+	if config.MaxImageAge == 0 {
+		config.MaxImageAge = defaultMaxImageAge
 	}
-	createdLag := time.Now().Sub(createdAt)
-	if createdLag < maximumImageAge {
-		return nil
+	if config.Now == nil {
+		config.Now = time.Now
 	}
-	preparingRunners.Inc()
-	defer preparingRunners.Dec()
-	err = a.provider.PrepareImage(ctx, a.config.PrepareOptions)
-	if err != nil {
-		return fmt.Errorf("prepare image: %w", err)
+	if config.Registerer == nil {
+		config.Registerer = prometheus.DefaultRegisterer
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
 	}
-	return nil
+	a := &Autoscaler{
+		tokenProvider:  tokenProvider,
+		demandProvider: config.DemandProvider,
+		journal:        config.Journal,
+		maxImageAge:    config.MaxImageAge,
+		now:            config.Now,
+		metrics:        newMetrics(config.Registerer),
+		logger:         config.Logger,
+		drainInterval:  time.Second * 5,
+	}
+	if config.RunnerRegistry != nil {
+		a.registrations = &registrationCache{registry: config.RunnerRegistry, now: config.Now, logger: config.Logger}
+	}
+	a.UpdatePools(config.Pools)
+	return a
 }
 
-func (a *Autoscaler) Autoscale(ctx context.Context, checkPrepare bool) error {
-	if checkPrepare {
-		err := a.maybePrepare(ctx)
+// UpdatePools replaces the pool configuration. Pools are matched by name so
+// that the state of existing pools is kept. The runners of removed pools are
+// left running.
+func (a *Autoscaler) UpdatePools(configs []PoolConfig) {
+	var pools []*pool
+	for _, config := range configs {
+		p, err := a.pool(config.Name)
 		if err != nil {
-			log.Default().Printf("error when preparing: %v", err)
+			p = &pool{
+				tokenProvider: a.tokenProvider,
+				registrations: a.registrations,
+				journal:       a.journal,
+				maxImageAge:   a.maxImageAge,
+				now:           a.now,
+				metrics:       a.metrics,
+				baseLogger:    a.logger,
+				activeSince:   make(map[string]time.Time),
+			}
+			// check the image of new pools right away
+			p.needsPrepareCheck.Store(true)
 		}
+		p.config.Store(&config)
+		pools = append(pools, p)
 	}
-	metrics, err := a.provider.RunnerDisposition(ctx)
-	if err != nil {
-		return fmt.Errorf("get runner disposition: %w", err)
-	}
+	a.mu.Lock()
+	a.pools = pools
+	a.mu.Unlock()
+}
 
-	updateMetrics(metrics)
+// getPools returns the current pools
+func (a *Autoscaler) getPools() []*pool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.pools
+}
 
-	log.Printf("status -> starting: %d, idle: %d, active: %d, total: %d", metrics.StartingCount(), metrics.IdleCount(), metrics.ActiveCount(), metrics.TotalCount())
-	idleStartingCount := metrics.StartingCount() + metrics.IdleCount()
+func (a *Autoscaler) pool(name string) (*pool, error) {
+	for _, p := range a.getPools() {
+		if p.cfg().Name == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrPoolNotFound, name)
+}
 
-	for i := idleStartingCount; i < a.config.TargetIdle; i++ {
-		log.Printf("creating instance (%d < %d)", i, a.config.TargetIdle)
-		url := a.tokenProvider.URL()
-		token, err := a.tokenProvider.Token(ctx)
+// Autoscale reconciles every pool. A failure in one pool does not prevent the
+// others from being reconciled.
+func (a *Autoscaler) Autoscale(ctx context.Context, checkPrepare bool) (err error) {
+	ctx, span := tracer.Start(ctx, "Autoscale", trace.WithAttributes(attribute.Bool("check_prepare", checkPrepare)))
+	defer func() { tracing.End(span, err) }()
+	registered := a.registrations.get(ctx)
+	pools := a.getPools()
+	pending := a.pendingJobs(ctx, pools)
+	var errs []error
+	for i, p := range pools {
+		err := p.autoscale(ctx, checkPrepare, registered, pending[i])
 		if err != nil {
-			return fmt.Errorf("get runner token: %w", err)
+			errs = append(errs, fmt.Errorf("pool %s: %w", p.cfg().Name, err))
 		}
-		err = a.provider.CreateRunner(ctx, url, token, a.config.Labels)
-		if err != nil {
-			return fmt.Errorf("create runner: %w", err)
+	}
+	if registered != nil && registered.fresh {
+		a.checkOrphans(registered)
+	}
+	return errors.Join(errs...)
+}
+
+// pendingJobs returns the number of queued jobs of each pool. Paused pools
+// don't take jobs which another pool could run.
+func (a *Autoscaler) pendingJobs(ctx context.Context, pools []*pool) []int {
+	pending := make([]int, len(pools))
+	if a.demandProvider == nil {
+		return pending
+	}
+	var active []int
+	var labels [][]string
+	for i, p := range pools {
+		if !p.paused.Load() {
+			active = append(active, i)
+			poolLabels := strings.Split(p.cfg().Labels, ",")
+			if p.cfg().Arch != "" {
+				poolLabels = append(poolLabels, p.cfg().Arch)
+			}
+			labels = append(labels, poolLabels)
 		}
-		log.Println("instance created")
 	}
-	return nil
+	counts, err := a.demandProvider.PendingJobs(ctx, labels)
+	if err != nil {
+		a.logger.Warn("error when getting pending jobs", "error", err)
+	}
+	for i, count := range counts {
+		pending[active[i]] = count
+	}
+	return pending
 }
 
-func (a *Autoscaler) Cleanup(ctx context.Context) error {
-	metrics, err := a.provider.RunnerDisposition(ctx)
+// DeleteRunner deletes a specific runner of a pool and deregisters it from
+// GitHub. It returns interfaces.ErrRunnerNotFound if id is not a runner of
+// the pool.
+func (a *Autoscaler) DeleteRunner(ctx context.Context, poolName, id string) error {
+	p, err := a.pool(poolName)
 	if err != nil {
-		return fmt.Errorf("get runner disposition: %w", err)
+		return err
 	}
-	deleteCount := metrics.IdleCount() + metrics.StartingCount()
-	err = a.provider.DeleteRunners(ctx, deleteCount, false)
+	runners, err := p.cfg().Provider.ListRunners(ctx)
 	if err != nil {
-		return fmt.Errorf("delete runners: %w", err)
+		return fmt.Errorf("list runners: %w", err)
+	}
+	if !slices.ContainsFunc(runners, func(runner interfaces.Runner) bool { return runner.ID == id }) {
+		return fmt.Errorf("%w: %s", interfaces.ErrRunnerNotFound, id)
+	}
+	return p.deleteRunners(ctx, []string{id}, interfaces.DeleteForce, true, "requested")
+}
+
+// Cleanup deletes all idle and starting runners. Active runners are left to
+// finish their jobs.
+func (a *Autoscaler) Cleanup(ctx context.Context) error {
+	registered := a.registrations.get(ctx)
+	var errs []error
+	for _, p := range a.getPools() {
+		err := p.cleanup(ctx, registered)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pool %s: %w", p.cfg().Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Drain deletes idle and starting runners then waits until no runners are
+// active or ctx is done
+func (a *Autoscaler) Drain(ctx context.Context) error {
+	err := a.Cleanup(ctx)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(a.drainInterval)
+	defer ticker.Stop()
+	for {
+		activeCount := 0
+		for _, p := range a.getPools() {
+			metrics, err := p.cfg().Provider.RunnerDisposition(ctx)
+			if err != nil {
+				return fmt.Errorf("pool %s: get runner disposition: %w", p.cfg().Name, err)
+			}
+			p.updateMetrics(metrics)
+			activeCount += metrics.ActiveCount()
+		}
+		if activeCount == 0 {
+			return nil
+		}
+		a.logger.Info("waiting for active runners to finish", "active", activeCount)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d runners still active: %w", activeCount, ctx.Err())
+		}
 	}
-	return nil
 }
@@ -0,0 +1,854 @@
+package autoscaler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/journal"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/fake"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gopkg.in/stretchr/testify.v1/require"
+)
+
+const testPool = "test"
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+type testTokenProvider struct {
+	mu      sync.Mutex
+	err     error
+	removed []string
+}
+
+func (p *testTokenProvider) URL() string {
+	return "https://github.com/org/repo"
+}
+
+func (p *testTokenProvider) Token(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return "token", p.err
+}
+
+func (p *testTokenProvider) RemoveRunner(ctx context.Context, name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.removed = append(p.removed, name)
+	return nil
+}
+
+func (p *testTokenProvider) setErr(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+type testDemand int
+
+func (d testDemand) PendingJobs(ctx context.Context, poolLabels [][]string) ([]int, error) {
+	res := make([]int, len(poolLabels))
+	for i := range res {
+		res[i] = int(d)
+	}
+	return res, nil
+}
+
+type testEnv struct {
+	clock    *testClock
+	provider *fake.Provider
+	tokens   *testTokenProvider
+	a        *Autoscaler
+}
+
+// newTestEnv creates an autoscaler with a single pool. Runners stay starting
+// until their state is set.
+func newTestEnv(t *testing.T, pool PoolConfig, config AutoscalerConfig) *testEnv {
+	env := &testEnv{
+		clock:  &testClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		tokens: &testTokenProvider{},
+	}
+	env.provider = fake.New(fake.Options{StartDelay: time.Hour * 1000, Now: env.clock.Now})
+	pool.Name = testPool
+	pool.Provider = env.provider
+	pool.Labels = "self-hosted,test"
+	config.Pools = []PoolConfig{pool}
+	config.Now = env.clock.Now
+	config.Registerer = prometheus.NewRegistry()
+	config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	env.a = New(env.tokens, config)
+	return env
+}
+
+// addRunners creates runners in each state without the autoscaler
+func (env *testEnv) addRunners(t *testing.T, states ...interfaces.RunnerState) []string {
+	var ids []string
+	for _, state := range states {
+		id, err := env.provider.CreateRunner(context.Background(), "", "", "")
+		require.NoError(t, err)
+		if state != interfaces.RunnerStateStarting {
+			require.NoError(t, env.provider.SetState(id, state))
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+type counts struct {
+	starting, idle, active int
+}
+
+func (env *testEnv) counts(t *testing.T) counts {
+	metrics, err := env.provider.RunnerDisposition(context.Background())
+	require.NoError(t, err)
+	return counts{metrics.StartingCount(), metrics.IdleCount(), metrics.ActiveCount()}
+}
+
+func TestPrepareScheduling(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxImageAge time.Duration
+		// age is how long after the first iteration the second one runs
+		age          time.Duration
+		checkPrepare bool
+		force        bool
+		wantImages   int
+	}{
+		{name: "keeps fresh image", age: time.Hour, checkPrepare: true, wantImages: 1},
+		{name: "replaces old image when checked", age: time.Hour * 25, checkPrepare: true, wantImages: 2},
+		{name: "ignores old image between checks", age: time.Hour * 25, wantImages: 1},
+		{name: "prepares when forced", age: time.Minute, force: true, wantImages: 2},
+		{name: "uses max image age", maxImageAge: time.Hour, age: time.Hour * 2, checkPrepare: true, wantImages: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			env := newTestEnv(t, PoolConfig{}, AutoscalerConfig{MaxImageAge: tt.maxImageAge})
+
+			// the missing image is prepared on the first iteration
+			require.NoError(t, env.a.Autoscale(ctx, false))
+			images, err := env.provider.ListImages(ctx)
+			require.NoError(t, err)
+			require.Len(t, images, 1)
+
+			env.clock.Advance(tt.age)
+			if tt.force {
+				require.NoError(t, env.a.Prepare(testPool))
+			}
+			require.NoError(t, env.a.Autoscale(ctx, tt.checkPrepare))
+			images, err = env.provider.ListImages(ctx)
+			require.NoError(t, err)
+			require.Len(t, images, tt.wantImages)
+			require.True(t, images[len(images)-1].Current)
+		})
+	}
+}
+
+func TestTargetIdleFill(t *testing.T) {
+	tests := []struct {
+		name     string
+		pool     PoolConfig
+		pending  int
+		existing []interfaces.RunnerState
+		want     counts
+	}{
+		{
+			name: "fills target idle",
+			pool: PoolConfig{TargetIdle: 3},
+			want: counts{starting: 3},
+		},
+		{
+			name:     "counts idle and starting runners",
+			pool:     PoolConfig{TargetIdle: 3},
+			existing: []interfaces.RunnerState{interfaces.RunnerStateIdle, interfaces.RunnerStateStarting},
+			want:     counts{starting: 2, idle: 1},
+		},
+		{
+			name:     "ignores active runners",
+			pool:     PoolConfig{TargetIdle: 1},
+			existing: []interfaces.RunnerState{interfaces.RunnerStateActive, interfaces.RunnerStateActive},
+			want:     counts{starting: 1, active: 2},
+		},
+		{
+			name:    "adds pending jobs",
+			pool:    PoolConfig{TargetIdle: 1},
+			pending: 2,
+			want:    counts{starting: 3},
+		},
+		{
+			name:     "limits total",
+			pool:     PoolConfig{TargetIdle: 5, MaxTotal: 3},
+			existing: []interfaces.RunnerState{interfaces.RunnerStateActive},
+			want:     counts{starting: 2, active: 1},
+		},
+		{
+			name:     "limits starting",
+			pool:     PoolConfig{TargetIdle: 5, MaxStarting: 2},
+			existing: []interfaces.RunnerState{interfaces.RunnerStateStarting},
+			want:     counts{starting: 2},
+		},
+		{
+			name: "limits creations per tick",
+			pool: PoolConfig{TargetIdle: 5, MaxCreatePerTick: 1},
+			want: counts{starting: 1},
+		},
+		{
+			name:     "keeps surplus until scale down delay",
+			pool:     PoolConfig{TargetIdle: 1, ScaleDownDelay: time.Minute},
+			existing: []interfaces.RunnerState{interfaces.RunnerStateIdle, interfaces.RunnerStateIdle},
+			want:     counts{idle: 2},
+		},
+		{
+			name:     "scales down without delay",
+			pool:     PoolConfig{TargetIdle: 1},
+			existing: []interfaces.RunnerState{interfaces.RunnerStateIdle, interfaces.RunnerStateIdle, interfaces.RunnerStateActive},
+			want:     counts{idle: 1, active: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config AutoscalerConfig
+			if tt.pending > 0 {
+				config.DemandProvider = testDemand(tt.pending)
+			}
+			env := newTestEnv(t, tt.pool, config)
+			env.addRunners(t, tt.existing...)
+			require.NoError(t, env.a.Autoscale(context.Background(), false))
+			require.Equal(t, tt.want, env.counts(t))
+		})
+	}
+}
+
+func TestScaleDownDelay(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, PoolConfig{ScaleDownDelay: time.Minute * 5}, AutoscalerConfig{})
+	ids := env.addRunners(t, interfaces.RunnerStateIdle, interfaces.RunnerStateStarting)
+
+	require.NoError(t, env.a.Autoscale(ctx, false))
+	env.clock.Advance(time.Minute * 4)
+	require.NoError(t, env.a.Autoscale(ctx, false))
+	require.Equal(t, counts{starting: 1, idle: 1}, env.counts(t))
+
+	env.clock.Advance(time.Minute * 2)
+	require.NoError(t, env.a.Autoscale(ctx, false))
+	require.Equal(t, counts{}, env.counts(t))
+	require.ElementsMatch(t, ids, env.tokens.removed)
+}
+
+func TestTokenFailures(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, PoolConfig{
+		TargetIdle:             3,
+		CreateConcurrency:      1,
+		CreateBreakerThreshold: 2,
+		CreateBreakerCooldown:  time.Minute,
+	}, AutoscalerConfig{})
+	tokenFailures := env.a.metrics.createFailures.WithLabelValues(testPool, "token")
+	breakerState := env.a.metrics.createBreakerState.WithLabelValues(testPool)
+
+	tokenErr := errors.New("bad credentials")
+	env.tokens.setErr(tokenErr)
+	err := env.a.Autoscale(ctx, false)
+	require.True(t, errors.Is(err, tokenErr), "unexpected error %v", err)
+	require.Equal(t, counts{}, env.counts(t))
+	require.Equal(t, 3.0, testutil.ToFloat64(tokenFailures))
+	require.Equal(t, float64(breakerOpen), testutil.ToFloat64(breakerState))
+
+	// the breaker stays open until the cooldown has passed
+	env.tokens.setErr(nil)
+	require.NoError(t, env.a.Autoscale(ctx, false))
+	require.Equal(t, counts{}, env.counts(t))
+
+	// a single probe closes it again
+	env.clock.Advance(time.Minute)
+	require.NoError(t, env.a.Autoscale(ctx, false))
+	require.Equal(t, counts{starting: 1}, env.counts(t))
+	require.Equal(t, float64(breakerClosed), testutil.ToFloat64(breakerState))
+
+	require.NoError(t, env.a.Autoscale(ctx, false))
+	require.Equal(t, counts{starting: 3}, env.counts(t))
+	require.Equal(t, 3.0, testutil.ToFloat64(tokenFailures))
+}
+
+func TestBreakerCanceledProbe(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, PoolConfig{
+		TargetIdle:             1,
+		CreateBreakerThreshold: 1,
+		CreateBreakerCooldown:  time.Minute,
+	}, AutoscalerConfig{})
+	breakerState := env.a.metrics.createBreakerState.WithLabelValues(testPool)
+
+	env.tokens.setErr(errors.New("bad credentials"))
+	require.Error(t, env.a.Autoscale(ctx, false))
+	require.Equal(t, float64(breakerOpen), testutil.ToFloat64(breakerState))
+
+	// a canceled probe doesn't block the next one
+	env.clock.Advance(time.Minute)
+	env.tokens.setErr(context.Canceled)
+	require.Error(t, env.a.Autoscale(ctx, false))
+	env.tokens.setErr(nil)
+	require.NoError(t, env.a.Autoscale(ctx, false))
+	require.Equal(t, counts{starting: 1}, env.counts(t))
+	require.Equal(t, float64(breakerClosed), testutil.ToFloat64(breakerState))
+}
+
+// blockingProvider holds CreateRunner calls until release is closed and
+// records how many were in flight. The call numbered fail fails.
+type blockingProvider struct {
+	*fake.Provider
+	entered chan struct{}
+	release chan struct{}
+	fail    int
+
+	mu          sync.Mutex
+	calls       int
+	inFlight    int
+	maxInFlight int
+}
+
+func (p *blockingProvider) CreateRunner(ctx context.Context, url, token, labels string) (string, error) {
+	p.mu.Lock()
+	p.calls++
+	call := p.calls
+	p.inFlight++
+	p.maxInFlight = max(p.maxInFlight, p.inFlight)
+	p.mu.Unlock()
+	p.entered <- struct{}{}
+	<-p.release
+	p.mu.Lock()
+	p.inFlight--
+	p.mu.Unlock()
+	if call == p.fail {
+		return "", errors.New("quota exceeded")
+	}
+	return p.Provider.CreateRunner(ctx, url, token, labels)
+}
+
+func TestCreateConcurrency(t *testing.T) {
+	env := newTestEnv(t, PoolConfig{TargetIdle: 5, CreateConcurrency: 2}, AutoscalerConfig{})
+	provider := &blockingProvider{
+		Provider: env.provider,
+		entered:  make(chan struct{}, 5),
+		release:  make(chan struct{}),
+		fail:     1,
+	}
+	p := env.a.getPools()[0]
+	cfg := *p.cfg()
+	cfg.Provider = provider
+	p.config.Store(&cfg)
+
+	done := make(chan error)
+	go func() {
+		done <- env.a.Autoscale(context.Background(), false)
+	}()
+	<-provider.entered
+	<-provider.entered
+	// no third creation starts while two are in flight
+	select {
+	case <-provider.entered:
+		t.Fatal("more than CreateConcurrency creations in flight")
+	case <-time.After(time.Millisecond * 50):
+	}
+	close(provider.release)
+	err := <-done
+
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "quota exceeded")
+	require.Equal(t, 5, provider.calls)
+	require.Equal(t, 2, provider.maxInFlight)
+	// the failure doesn't lose the other creations
+	require.Equal(t, counts{starting: 4}, env.counts(t))
+	require.Equal(t, 4.0, testutil.ToFloat64(env.a.metrics.runnersCreated.WithLabelValues(testPool)))
+	require.Equal(t, 1.0, testutil.ToFloat64(env.a.metrics.createFailures.WithLabelValues(testPool, "provider")))
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		want     time.Duration
+	}{
+		{name: "success", want: time.Second},
+		{name: "one failure", failures: 1, want: 2 * time.Second},
+		{name: "three failures", failures: 3, want: 8 * time.Second},
+		{name: "capped", failures: 5, want: 30 * time.Second},
+		{name: "many failures", failures: 100, want: 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delays := make(map[time.Duration]bool)
+			for range 100 {
+				b := &Backoff{Min: time.Second, Max: 30 * time.Second}
+				var delay time.Duration
+				if tt.failures == 0 {
+					delay = b.Next(nil)
+				}
+				for range tt.failures {
+					delay = b.Next(errors.New("failed"))
+				}
+				require.Equal(t, tt.failures, b.Failures())
+				// up to 25% jitter is subtracted
+				require.True(t, delay <= tt.want && delay >= tt.want*3/4, "delay %s for %s", delay, tt.want)
+				delays[delay] = true
+			}
+			if tt.failures > 0 {
+				require.True(t, len(delays) > 1, "no jitter")
+			}
+		})
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	b := &Backoff{Min: time.Second, Max: 30 * time.Second}
+	for range 10 {
+		b.Next(errors.New("failed"))
+	}
+	require.Equal(t, time.Second, b.Next(nil))
+	require.Equal(t, 0, b.Failures())
+
+	// growth starts over after a success
+	delay := b.Next(errors.New("failed"))
+	require.True(t, delay <= 2*time.Second && delay >= 1500*time.Millisecond, "delay %s", delay)
+}
+
+func TestCleanup(t *testing.T) {
+	tests := []struct {
+		name       string
+		existing   []interfaces.RunnerState
+		want       counts
+		wantRemove int
+	}{
+		{name: "no runners"},
+		{
+			name:       "deletes idle and starting runners",
+			existing:   []interfaces.RunnerState{interfaces.RunnerStateIdle, interfaces.RunnerStateStarting, interfaces.RunnerStateIdle},
+			wantRemove: 3,
+		},
+		{
+			name:       "leaves active runners",
+			existing:   []interfaces.RunnerState{interfaces.RunnerStateActive, interfaces.RunnerStateIdle},
+			want:       counts{active: 1},
+			wantRemove: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, PoolConfig{}, AutoscalerConfig{})
+			env.addRunners(t, tt.existing...)
+			require.NoError(t, env.a.Cleanup(context.Background()))
+			require.Equal(t, tt.want, env.counts(t))
+			require.Len(t, env.tokens.removed, tt.wantRemove)
+		})
+	}
+}
+
+// partialDeleteProvider only deletes the first runner of every request
+type partialDeleteProvider struct {
+	interfaces.Provider
+}
+
+func (p partialDeleteProvider) DeleteRunnersByID(ctx context.Context, ids []string, mode interfaces.DeleteMode, wait bool) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	deleted, err := p.Provider.DeleteRunnersByID(ctx, ids[:1], mode, wait)
+	if err != nil {
+		return deleted, err
+	}
+	return deleted, errors.New("instance busy")
+}
+
+func TestDeleteFailures(t *testing.T) {
+	env := newTestEnv(t, PoolConfig{}, AutoscalerConfig{})
+	p := env.a.getPools()[0]
+	cfg := *p.cfg()
+	cfg.Provider = partialDeleteProvider{env.provider}
+	p.config.Store(&cfg)
+	ids := env.addRunners(t, interfaces.RunnerStateIdle, interfaces.RunnerStateIdle)
+
+	err := p.deleteRunners(context.Background(), ids, interfaces.DeleteForce, true, "test")
+	require.Error(t, err)
+	require.Equal(t, counts{idle: 1}, env.counts(t))
+	// the runner of the remaining instance stays registered
+	require.Equal(t, ids[:1], env.tokens.removed)
+	require.Equal(t, 1.0, testutil.ToFloat64(env.a.metrics.deleteFailures.WithLabelValues(testPool, "provider")))
+}
+
+// jobTakingProvider makes a runner take a job right before it is deleted
+type jobTakingProvider struct {
+	*fake.Provider
+	busy string
+}
+
+func (p jobTakingProvider) DeleteRunnersByID(ctx context.Context, ids []string, mode interfaces.DeleteMode, wait bool) ([]string, error) {
+	err := p.SetState(p.busy, interfaces.RunnerStateActive)
+	if err != nil {
+		return nil, err
+	}
+	return p.Provider.DeleteRunnersByID(ctx, ids, mode, wait)
+}
+
+func TestDeleteSkipsRunnerWhichTookJob(t *testing.T) {
+	tests := []struct {
+		name      string
+		autoscale bool
+	}{
+		{name: "cleanup"},
+		{name: "scale down", autoscale: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			env := newTestEnv(t, PoolConfig{}, AutoscalerConfig{})
+			ids := env.addRunners(t, interfaces.RunnerStateIdle, interfaces.RunnerStateIdle)
+			p := env.a.getPools()[0]
+			cfg := *p.cfg()
+			cfg.Provider = jobTakingProvider{Provider: env.provider, busy: ids[0]}
+			p.config.Store(&cfg)
+
+			if tt.autoscale {
+				require.NoError(t, env.a.Autoscale(ctx, false))
+			} else {
+				require.NoError(t, env.a.Cleanup(ctx))
+			}
+			require.Equal(t, counts{active: 1}, env.counts(t))
+			// the busy runner stays registered
+			require.Equal(t, ids[1:], env.tokens.removed)
+		})
+	}
+}
+
+// editingProvider changes the runners listed by the fake provider
+type editingProvider struct {
+	*fake.Provider
+	edit func(runner *interfaces.Runner)
+}
+
+func (p editingProvider) ListRunners(ctx context.Context) ([]interfaces.Runner, error) {
+	runners, err := p.Provider.ListRunners(ctx)
+	for i := range runners {
+		p.edit(&runners[i])
+	}
+	return runners, err
+}
+
+// editRunners makes the pool see runners changed by edit
+func (env *testEnv) editRunners(edit func(runner *interfaces.Runner)) {
+	p := env.a.getPools()[0]
+	cfg := *p.cfg()
+	cfg.Provider = editingProvider{Provider: env.provider, edit: edit}
+	p.config.Store(&cfg)
+}
+
+// runnerExists checks if the provider still has a runner
+func (env *testEnv) runnerExists(t *testing.T, id string) bool {
+	runners, err := env.provider.ListRunners(context.Background())
+	require.NoError(t, err)
+	return slices.ContainsFunc(runners, func(runner interfaces.Runner) bool { return runner.ID == id })
+}
+
+func TestReapStartingRunners(t *testing.T) {
+	tests := []struct {
+		name            string
+		startingTimeout time.Duration
+		age             time.Duration
+		zeroCreatedAt   bool
+		wantReaped      bool
+	}{
+		{name: "reaps stuck runner", startingTimeout: time.Minute * 10, age: time.Minute * 11, wantReaped: true},
+		{name: "keeps runner within timeout", startingTimeout: time.Minute * 10, age: time.Minute * 9},
+		{name: "disabled", age: time.Hour * 24},
+		{name: "unknown creation time", startingTimeout: time.Minute * 10, age: time.Minute * 11, zeroCreatedAt: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			// the starting runner is needed so it isn't scaled down
+			env := newTestEnv(t, PoolConfig{TargetIdle: 1, StartingTimeout: tt.startingTimeout}, AutoscalerConfig{})
+			if tt.zeroCreatedAt {
+				env.editRunners(func(runner *interfaces.Runner) { runner.CreatedAt = time.Time{} })
+			}
+			ids := env.addRunners(t, interfaces.RunnerStateStarting)
+			env.clock.Advance(tt.age)
+
+			require.NoError(t, env.a.Autoscale(ctx, false))
+			require.Equal(t, !tt.wantReaped, env.runnerExists(t, ids[0]))
+			reaped := testutil.ToFloat64(env.a.metrics.reapedRunners.WithLabelValues(testPool))
+			if tt.wantReaped {
+				require.Equal(t, 1.0, reaped)
+				require.Equal(t, ids, env.tokens.removed)
+			} else {
+				require.Equal(t, 0.0, reaped)
+				require.Empty(t, env.tokens.removed)
+			}
+		})
+	}
+}
+
+func TestMaxActiveDuration(t *testing.T) {
+	tests := []struct {
+		name              string
+		maxActiveDuration time.Duration
+		age               time.Duration
+		wantDeleted       bool
+	}{
+		{name: "deletes runner over the limit", maxActiveDuration: time.Hour, age: time.Minute * 61, wantDeleted: true},
+		{name: "keeps runner under the limit", maxActiveDuration: time.Hour, age: time.Minute * 59},
+		{name: "disabled", age: time.Hour * 24},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			env := newTestEnv(t, PoolConfig{MaxActiveDuration: tt.maxActiveDuration}, AutoscalerConfig{})
+			ids := env.addRunners(t, interfaces.RunnerStateActive)
+			require.NoError(t, env.a.Autoscale(ctx, false))
+			env.clock.Advance(tt.age)
+
+			require.NoError(t, env.a.Autoscale(ctx, false))
+			require.Equal(t, !tt.wantDeleted, env.runnerExists(t, ids[0]))
+			timeouts := testutil.ToFloat64(env.a.metrics.activeTimeouts.WithLabelValues(testPool))
+			if tt.wantDeleted {
+				require.Equal(t, 1.0, timeouts)
+				require.Equal(t, ids, env.tokens.removed)
+			} else {
+				require.Equal(t, 0.0, timeouts)
+				require.Empty(t, env.tokens.removed)
+			}
+		})
+	}
+}
+
+func TestMaxActiveDurationReset(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, PoolConfig{MaxActiveDuration: time.Hour, ScaleDownDelay: time.Hour * 24}, AutoscalerConfig{})
+	// without a state change time the pool uses when it first saw the runner
+	// active
+	env.editRunners(func(runner *interfaces.Runner) { runner.LastStateChange = time.Time{} })
+	ids := env.addRunners(t, interfaces.RunnerStateActive)
+	require.NoError(t, env.a.Autoscale(ctx, false))
+
+	env.clock.Advance(time.Minute * 40)
+	require.NoError(t, env.provider.SetState(ids[0], interfaces.RunnerStateIdle))
+	require.NoError(t, env.a.Autoscale(ctx, false))
+	require.NoError(t, env.provider.SetState(ids[0], interfaces.RunnerStateActive))
+	require.NoError(t, env.a.Autoscale(ctx, false))
+
+	// 80 minutes since it first became active but only 40 since the second
+	// time
+	env.clock.Advance(time.Minute * 40)
+	require.NoError(t, env.a.Autoscale(ctx, false))
+	require.True(t, env.runnerExists(t, ids[0]))
+
+	env.clock.Advance(time.Minute * 21)
+	require.NoError(t, env.a.Autoscale(ctx, false))
+	require.False(t, env.runnerExists(t, ids[0]))
+	require.Equal(t, 1.0, testutil.ToFloat64(env.a.metrics.activeTimeouts.WithLabelValues(testPool)))
+}
+
+// tickingProvider advances the clock whenever the disposition is checked
+type tickingProvider struct {
+	*fake.Provider
+	clock *testClock
+	tick  time.Duration
+	calls int
+}
+
+func (p *tickingProvider) RunnerDisposition(ctx context.Context) (interfaces.RunnerDispositionMetrics, error) {
+	p.calls++
+	p.clock.Advance(p.tick)
+	return p.Provider.RunnerDisposition(ctx)
+}
+
+func TestDrain(t *testing.T) {
+	env := newTestEnv(t, PoolConfig{}, AutoscalerConfig{})
+	env.a.drainInterval = time.Millisecond
+	env.addRunners(t, interfaces.RunnerStateIdle, interfaces.RunnerStateIdle)
+	_, ok := env.provider.AssignJob(time.Minute * 10)
+	require.True(t, ok)
+	provider := &tickingProvider{Provider: env.provider, clock: env.clock, tick: time.Minute * 4}
+	p := env.a.getPools()[0]
+	cfg := *p.cfg()
+	cfg.Provider = provider
+	p.config.Store(&cfg)
+
+	// the idle runner is deleted right away and the job finishes on the third
+	// check
+	require.NoError(t, env.a.Drain(context.Background()))
+	require.Equal(t, 3, provider.calls)
+	require.Equal(t, counts{}, env.counts(t))
+	require.Len(t, env.tokens.removed, 1)
+}
+
+func TestDrainTimeout(t *testing.T) {
+	env := newTestEnv(t, PoolConfig{}, AutoscalerConfig{})
+	env.a.drainInterval = time.Millisecond
+	env.addRunners(t, interfaces.RunnerStateActive, interfaces.RunnerStateIdle)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	err := env.a.Drain(ctx)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error %v", err)
+	require.Contains(t, err.Error(), "1 runners still active")
+	require.Equal(t, counts{active: 1}, env.counts(t))
+}
+
+type testRegistry struct {
+	runners []interfaces.RegisteredRunner
+	err     error
+	calls   int
+}
+
+func (r *testRegistry) RegisteredRunners(ctx context.Context) ([]interfaces.RegisteredRunner, error) {
+	r.calls++
+	return r.runners, r.err
+}
+
+func TestRunnerRegistry(t *testing.T) {
+	ctx := context.Background()
+	registry := &testRegistry{}
+	env := newTestEnv(t, PoolConfig{TargetIdle: 1}, AutoscalerConfig{RunnerRegistry: registry})
+	ids := env.addRunners(t, interfaces.RunnerStateStarting, interfaces.RunnerStateIdle, interfaces.RunnerStateIdle)
+	registry.runners = []interfaces.RegisteredRunner{
+		// GitHub knows the starting runner picked up a job
+		{Name: ids[0], Status: "online", Busy: true, Labels: []string{"self-hosted", "test"}},
+		{Name: ids[1], Status: "online", Labels: []string{"self-hosted", "test"}},
+		{Name: "gone", Status: "offline", Labels: []string{"self-hosted", "Linux", "test"}},
+		{Name: "unmanaged", Status: "online", Labels: []string{"self-hosted", "other"}},
+	}
+	gauge := func(vec *prometheus.GaugeVec) float64 {
+		return testutil.ToFloat64(vec.WithLabelValues(testPool))
+	}
+
+	// one idle runner is surplus. The busy runner is never deleted.
+	require.NoError(t, env.a.Autoscale(ctx, false))
+	require.Equal(t, 1.0, gauge(env.a.metrics.activeRunners))
+	require.Equal(t, 2.0, gauge(env.a.metrics.idleRunners))
+	require.Equal(t, 1.0, gauge(env.a.metrics.unregisteredInstances))
+	require.Equal(t, 1.0, gauge(env.a.metrics.orphanedRunners))
+	require.Len(t, env.tokens.removed, 1)
+	require.NotEqual(t, ids[0], env.tokens.removed[0])
+
+	// the listing is reused without reporting mismatches again. The cached
+	// busy state still applies.
+	registry.runners = nil
+	require.NoError(t, env.a.Autoscale(ctx, false))
+	require.Equal(t, 1, registry.calls)
+	require.Equal(t, 1.0, gauge(env.a.metrics.activeRunners))
+	require.Equal(t, 1.0, gauge(env.a.metrics.orphanedRunners))
+
+	// the provider state is used when listing registered runners fails
+	registry.err = errors.New("rate limited")
+	env.clock.Advance(registrationsMaxAge)
+	require.NoError(t, env.a.Autoscale(ctx, false))
+	require.Equal(t, 2, registry.calls)
+	require.Equal(t, 0.0, gauge(env.a.metrics.activeRunners))
+	require.Equal(t, 1.0, gauge(env.a.metrics.startingRunners))
+	require.Equal(t, 1.0, gauge(env.a.metrics.idleRunners))
+}
+
+func TestRunnerRegistryPaused(t *testing.T) {
+	ctx := context.Background()
+	registry := &testRegistry{}
+	env := newTestEnv(t, PoolConfig{TargetIdle: 1}, AutoscalerConfig{RunnerRegistry: registry})
+	ids := env.addRunners(t, interfaces.RunnerStateIdle)
+	registry.runners = []interfaces.RegisteredRunner{
+		{Name: ids[0], Status: "online", Labels: []string{"self-hosted", "test"}},
+		{Name: "gone", Status: "offline", Labels: []string{"self-hosted", "test"}},
+	}
+	require.NoError(t, env.a.SetPaused(testPool, true))
+
+	require.NoError(t, env.a.Autoscale(ctx, false))
+	require.Equal(t, 1.0, testutil.ToFloat64(env.a.metrics.orphanedRunners.WithLabelValues(testPool)))
+	require.Equal(t, counts{idle: 1}, env.counts(t))
+}
+
+// labelDemand records the labels it was asked about and returns a job for
+// each pool
+type labelDemand struct {
+	poolLabels [][]string
+}
+
+func (d *labelDemand) PendingJobs(ctx context.Context, poolLabels [][]string) ([]int, error) {
+	d.poolLabels = poolLabels
+	res := make([]int, len(poolLabels))
+	for i := range res {
+		res[i] = 1
+	}
+	return res, nil
+}
+
+func TestPendingJobsPaused(t *testing.T) {
+	demand := &labelDemand{}
+	env := newTestEnv(t, PoolConfig{}, AutoscalerConfig{DemandProvider: demand})
+	other := fake.New(fake.Options{StartDelay: time.Hour * 1000, Now: env.clock.Now})
+	env.a.UpdatePools([]PoolConfig{
+		*env.a.getPools()[0].cfg(),
+		{Name: "other", Provider: other, Labels: "self-hosted,other", Arch: "arm64"},
+	})
+	require.NoError(t, env.a.SetPaused(testPool, true))
+
+	require.NoError(t, env.a.Autoscale(context.Background(), false))
+	require.Equal(t, [][]string{{"self-hosted", "other", "arm64"}}, demand.poolLabels)
+	require.Equal(t, counts{}, env.counts(t))
+	metrics, err := other.RunnerDisposition(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, metrics.StartingCount())
+}
+
+func TestJournalCorrelation(t *testing.T) {
+	var buf bytes.Buffer
+	var env *testEnv
+	j := journal.New(&buf, func() time.Time { return env.clock.Now() })
+	env = newTestEnv(t, PoolConfig{TargetIdle: 2}, AutoscalerConfig{Journal: j})
+	env.clock.Advance(time.Hour)
+	require.NoError(t, env.a.Autoscale(context.Background(), false))
+
+	requests := make(map[string]journal.Event)
+	var created []journal.Event
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var event journal.Event
+		require.NoError(t, decoder.Decode(&event))
+		// events are stamped with the autoscaler's clock
+		require.True(t, event.Time.Equal(env.clock.Now()), "event time %s", event.Time)
+		switch event.Type {
+		case journal.RunnerRequested:
+			requests[event.RequestID] = event
+		case journal.RunnerCreated:
+			created = append(created, event)
+		}
+	}
+	require.Len(t, requests, 2)
+	require.Len(t, created, 2)
+	for _, event := range created {
+		request, ok := requests[event.RequestID]
+		require.True(t, ok, "no request for %s", event.Instance)
+		require.NotEmpty(t, event.Reason)
+		require.Equal(t, request.Reason, event.Reason)
+	}
+}
@@ -0,0 +1,36 @@
+package autoscaler
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff computes the delay between reconcile iterations. The delay doubles
+// with every consecutive failure up to Max and is reset by a success.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	failures int
+}
+
+// Next returns how long to wait after an iteration which returned err
+func (b *Backoff) Next(err error) time.Duration {
+	if err == nil {
+		b.failures = 0
+		return b.Min
+	}
+	b.failures++
+	delay := b.Min
+	for i := 0; i < b.failures && delay < b.Max; i++ {
+		delay *= 2
+	}
+	delay = min(delay, b.Max)
+	// up to 25% jitter so replicas and pools don't retry in lockstep
+	return delay - time.Duration(rand.Int64N(int64(delay)/4+1))
+}
+
+// Failures is the number of consecutive failures
+func (b *Backoff) Failures() int {
+	return b.failures
+}
@@ -0,0 +1,95 @@
+package autoscaler
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	// breakerClosed allows creating runners
+	breakerClosed breakerState = iota
+	// breakerOpen blocks creating runners until the cooldown has passed
+	breakerOpen
+	// breakerHalfOpen allows a single probe runner to be created
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker stops creating runners after repeated failures such as an
+// exhausted quota. It is safe for concurrent use.
+type breaker struct {
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	// probing is set while the half-open probe is in flight
+	probing bool
+}
+
+// allow limits count by the breaker state at now. threshold is the number of
+// consecutive failures which open the breaker (0 disables) and cooldown is
+// how long it stays open before a probe is allowed.
+func (b *breaker) allow(now time.Time, count, threshold int, cooldown time.Duration) (int, breakerState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if threshold <= 0 {
+		b.state = breakerClosed
+		b.failures = 0
+		return count, b.state
+	}
+	if b.state == breakerOpen && now.Sub(b.openedAt) >= cooldown {
+		b.state = breakerHalfOpen
+	}
+	switch b.state {
+	case breakerOpen:
+		return 0, b.state
+	case breakerHalfOpen:
+		if b.probing || count == 0 {
+			return 0, b.state
+		}
+		b.probing = true
+		return 1, b.state
+	}
+	return count, b.state
+}
+
+// record updates the breaker with the result of a creation which finished at
+// now. It returns the new state and whether it changed.
+func (b *breaker) record(now time.Time, err error, threshold int) (breakerState, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prev := b.state
+	if err == nil {
+		b.state = breakerClosed
+		b.failures = 0
+		b.probing = false
+		return b.state, b.state != prev
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (threshold > 0 && b.failures >= threshold) {
+		b.state = breakerOpen
+		b.openedAt = now
+		b.probing = false
+	}
+	return b.state, b.state != prev
+}
+
+// release allows another probe after a creation which ended without a result,
+// for example because it was canceled
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
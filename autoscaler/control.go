@@ -0,0 +1,104 @@
+package autoscaler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+)
+
+// PoolStatus is the current configuration and runner counts of a pool
+type PoolStatus struct {
+	Name       string   `json:"name"`
+	Provider   string   `json:"provider"`
+	Labels     []string `json:"labels"`
+	TargetIdle int      `json:"target_idle"`
+	Paused     bool     `json:"paused"`
+	Starting   int      `json:"starting"`
+	Idle       int      `json:"idle"`
+	Active     int      `json:"active"`
+	Total      int      `json:"total"`
+}
+
+// Pools returns the status of every pool
+func (a *Autoscaler) Pools(ctx context.Context) ([]PoolStatus, error) {
+	var res []PoolStatus
+	for _, p := range a.getPools() {
+		config := p.cfg()
+		metrics, err := config.Provider.RunnerDisposition(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: get runner disposition: %w", config.Name, err)
+		}
+		res = append(res, PoolStatus{
+			Name:       config.Name,
+			Provider:   config.ProviderName,
+			Labels:     strings.Split(config.Labels, ","),
+			TargetIdle: config.TargetIdle,
+			Paused:     p.paused.Load(),
+			Starting:   metrics.StartingCount(),
+			Idle:       metrics.IdleCount(),
+			Active:     metrics.ActiveCount(),
+			Total:      metrics.TotalCount(),
+		})
+	}
+	return res, nil
+}
+
+// ListRunners returns the runners of a pool
+func (a *Autoscaler) ListRunners(ctx context.Context, poolName string) ([]interfaces.Runner, error) {
+	p, err := a.pool(poolName)
+	if err != nil {
+		return nil, err
+	}
+	return p.cfg().Provider.ListRunners(ctx)
+}
+
+// SetPaused stops or resumes scaling a pool. Runners of a paused pool are
+// left as they are.
+func (a *Autoscaler) SetPaused(poolName string, paused bool) error {
+	p, err := a.pool(poolName)
+	if err != nil {
+		return err
+	}
+	if p.paused.Swap(paused) != paused {
+		p.logger().Info("changed paused", "paused", paused)
+	}
+	return nil
+}
+
+// SetTargetIdle changes TargetIdle until the pools are next updated
+func (a *Autoscaler) SetTargetIdle(poolName string, targetIdle int) error {
+	p, err := a.pool(poolName)
+	if err != nil {
+		return err
+	}
+	if targetIdle < 0 {
+		return fmt.Errorf("target idle must not be negative")
+	}
+	// retry if the pools were updated in the meantime so that neither
+	// change is lost
+	for {
+		prev := p.cfg()
+		if prev.MaxTotal > 0 && targetIdle > prev.MaxTotal {
+			return fmt.Errorf("target idle must not be greater than max total %d", prev.MaxTotal)
+		}
+		config := *prev
+		config.TargetIdle = targetIdle
+		if p.config.CompareAndSwap(prev, &config) {
+			p.logger().Info("changed target idle", "from", prev.TargetIdle, "to", targetIdle)
+			return nil
+		}
+	}
+}
+
+// Prepare prepares a new image for a pool on the next autoscale even if the
+// current image is not old
+func (a *Autoscaler) Prepare(poolName string) error {
+	p, err := a.pool(poolName)
+	if err != nil {
+		return err
+	}
+	p.forcePrepare.Store(true)
+	return nil
+}
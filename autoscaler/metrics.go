@@ -0,0 +1,167 @@
+package autoscaler
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var poolLabels = []string{"pool"}
+
+// failureLabels classify failures by the step which failed
+var failureLabels = []string{"pool", "reason"}
+
+// metrics are registered per autoscaler so that tests can use their own
+// registry
+type metrics struct {
+	totalRunners          *prometheus.GaugeVec
+	startingRunners       *prometheus.GaugeVec
+	idleRunners           *prometheus.GaugeVec
+	activeRunners         *prometheus.GaugeVec
+	preparingRunners      *prometheus.GaugeVec
+	pendingJobs           *prometheus.GaugeVec
+	runnersCreated        *prometheus.CounterVec
+	createFailures        *prometheus.CounterVec
+	deleteFailures        *prometheus.CounterVec
+	prepareFailures       *prometheus.CounterVec
+	reapedRunners         *prometheus.CounterVec
+	activeTimeouts        *prometheus.CounterVec
+	createBreakerState    *prometheus.GaugeVec
+	unregisteredInstances *prometheus.GaugeVec
+	orphanedRunners       *prometheus.GaugeVec
+	imageAge              *prometheus.GaugeVec
+	createDuration        *prometheus.HistogramVec
+	timeToIdle            *prometheus.HistogramVec
+	jobDuration           *prometheus.HistogramVec
+	prepareDuration       *prometheus.HistogramVec
+	tokenDuration         *prometheus.HistogramVec
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	return &metrics{
+		totalRunners: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "total",
+			Help:      "Total number of GitHub Actions runners",
+		}, poolLabels)),
+		startingRunners: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "starting",
+			Help:      "Number of GitHub Actions runners in starting state",
+		}, poolLabels)),
+		idleRunners: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "idle",
+			Help:      "Number of GitHub Actions runners in idle state",
+		}, poolLabels)),
+		activeRunners: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active",
+			Help:      "Number of GitHub Actions runners in active state",
+		}, poolLabels)),
+		preparingRunners: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "preparing",
+			Help:      "Number of instances running for image preparation",
+		}, poolLabels)),
+		pendingJobs: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "pending_jobs",
+			Help:      "Number of queued jobs waiting for a runner",
+		}, poolLabels)),
+		runnersCreated: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "created_total",
+			Help:      "Number of runners successfully created",
+		}, poolLabels)),
+		createFailures: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "create_failures_total",
+			Help:      "Number of runners which failed to be created",
+		}, failureLabels)),
+		deleteFailures: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "delete_failures_total",
+			Help:      "Number of runner deletions which failed",
+		}, failureLabels)),
+		prepareFailures: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "prepare_failures_total",
+			Help:      "Number of image preparations which failed",
+		}, failureLabels)),
+		reapedRunners: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reaped_total",
+			Help:      "Number of runners deleted because they were starting for longer than the starting timeout",
+		}, poolLabels)),
+		activeTimeouts: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_timeouts_total",
+			Help:      "Number of runners deleted because they were active for longer than the max active duration",
+		}, poolLabels)),
+		createBreakerState: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "create_breaker_state",
+			Help:      "State of the runner creation circuit breaker (0 closed, 1 open, 2 half-open)",
+		}, poolLabels)),
+		unregisteredInstances: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "unregistered_instances",
+			Help:      "Number of idle or active instances without a runner registered with GitHub",
+		}, poolLabels)),
+		orphanedRunners: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "orphaned_runners",
+			Help:      "Number of runners registered with GitHub without an instance",
+		}, poolLabels)),
+		imageAge: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "image_age_seconds",
+			Help:      "Age of the current runner image",
+		}, poolLabels)),
+		createDuration: register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "create_duration_seconds",
+			Help:      "Time taken by the provider to create a runner",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		}, poolLabels)),
+		timeToIdle: register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "time_to_idle_seconds",
+			Help:      "Time from a runner being created until it is idle and can accept jobs",
+			Buckets:   prometheus.ExponentialBuckets(5, 2, 10),
+		}, poolLabels)),
+		jobDuration: register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "job_duration_seconds",
+			Help:      "Time from a runner becoming active until it is gone",
+			Buckets:   prometheus.ExponentialBuckets(30, 2, 12),
+		}, poolLabels)),
+		prepareDuration: register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "prepare_duration_seconds",
+			Help:      "Time taken to prepare a runner image",
+			Buckets:   prometheus.ExponentialBuckets(30, 2, 8),
+		}, poolLabels)),
+		tokenDuration: register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "token_fetch_duration_seconds",
+			Help:      "Time taken to fetch a runner registration token from GitHub",
+			Buckets:   prometheus.DefBuckets,
+		}, poolLabels)),
+	}
+}
+
+// register registers c or returns the collector which is already registered
+// so that multiple autoscalers can share a registry
+func register[T prometheus.Collector](reg prometheus.Registerer, c T) T {
+	err := reg.Register(c)
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		return registered.ExistingCollector.(T)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
@@ -0,0 +1,525 @@
+package autoscaler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/journal"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// pool is reconciled by the autoscale loop. Fields which may also be used by
+// the admin API are atomic or guarded by a mutex.
+type pool struct {
+	config        atomic.Pointer[PoolConfig]
+	tokenProvider RunnerTokenProvider
+	registrations *registrationCache
+	journal       *journal.Journal
+	maxImageAge   time.Duration
+	now           func() time.Time
+	metrics       *metrics
+	baseLogger    *slog.Logger
+
+	// surplusSince is when we first saw more idle runners than needed
+	surplusSince time.Time
+	// activeSince is when we first saw each runner in the active state
+	activeSince map[string]time.Time
+	// needsPrepareCheck forces an image check on the next autoscale
+	needsPrepareCheck atomic.Bool
+	// forcePrepare prepares a new image on the next autoscale regardless of
+	// the age of the current one
+	forcePrepare atomic.Bool
+	// paused stops scaling until it is resumed
+	paused atomic.Bool
+	// createBreaker stops runner creation after repeated failures
+	createBreaker breaker
+	// observed is the last state of each runner seen by observeRunners
+	observed   map[string]interfaces.RunnerState
+	observedMu sync.Mutex
+	// instances are the runners seen by the last autoscale. It is nil if
+	// they are not known.
+	instances map[string]bool
+	// unregistered and orphaned are the last reported mismatches with the
+	// registered runners
+	unregistered map[string]bool
+	orphaned     map[string]bool
+	// imageCreatedAt is when the current image was created as of the last
+	// prepare check
+	imageCreatedAt time.Time
+}
+
+func (p *pool) cfg() *PoolConfig {
+	return p.config.Load()
+}
+
+func (p *pool) updateMetrics(metrics interfaces.RunnerDispositionMetrics) {
+	p.metrics.totalRunners.WithLabelValues(p.cfg().Name).Set(float64(metrics.TotalCount()))
+	p.metrics.startingRunners.WithLabelValues(p.cfg().Name).Set(float64(metrics.StartingCount()))
+	p.metrics.idleRunners.WithLabelValues(p.cfg().Name).Set(float64(metrics.IdleCount()))
+	p.metrics.activeRunners.WithLabelValues(p.cfg().Name).Set(float64(metrics.ActiveCount()))
+	if !p.imageCreatedAt.IsZero() {
+		p.metrics.imageAge.WithLabelValues(p.cfg().Name).Set(p.since(p.imageCreatedAt).Seconds())
+	}
+}
+
+func (p *pool) since(t time.Time) time.Duration {
+	return p.now().Sub(t)
+}
+
+func (p *pool) logger() *slog.Logger {
+	return p.baseLogger.With("pool", p.cfg().Name, "provider", p.cfg().ProviderName)
+}
+
+// record writes an event for this pool to the journal
+func (p *pool) record(event journal.Event) {
+	event.Pool = p.cfg().Name
+	err := p.journal.Record(event)
+	if err != nil {
+		p.logger().Warn("error when writing journal", "error", err)
+	}
+}
+
+func (p *pool) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attribute.String("pool", p.cfg().Name))
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// maybePrepare prepares a new image if the current one is too old or force is
+// set
+func (p *pool) maybePrepare(ctx context.Context, force bool) (err error) {
+	ctx, span := p.startSpan(ctx, "maybePrepare", attribute.Bool("force", force))
+	defer func() { tracing.End(span, err) }()
+	createdAt, err := p.cfg().Provider.ImageCreatedAt(ctx)
+	if err != nil {
+		p.metrics.prepareFailures.WithLabelValues(p.cfg().Name, "image_check").Inc()
+		return fmt.Errorf("get image created at: %w", err)
+	}
+	p.imageCreatedAt = createdAt
+	createdLag := p.since(createdAt)
+	if createdLag < p.maxImageAge && !force {
+		return nil
+	}
+	p.metrics.preparingRunners.WithLabelValues(p.cfg().Name).Inc()
+	defer p.metrics.preparingRunners.WithLabelValues(p.cfg().Name).Dec()
+	p.logger().Info("preparing image", "operation", "prepare", "image_age", createdLag.Round(time.Second))
+	p.record(journal.Event{Type: journal.PrepareStarted})
+	start := p.now()
+	err = p.cfg().Provider.PrepareImage(ctx, p.cfg().PrepareOptions)
+	if err != nil {
+		p.metrics.prepareFailures.WithLabelValues(p.cfg().Name, "prepare").Inc()
+		p.record(journal.Event{Type: journal.PrepareFailed, Error: err.Error(), DurationSeconds: p.since(start).Seconds()})
+		return fmt.Errorf("prepare image: %w", err)
+	}
+	p.metrics.prepareDuration.WithLabelValues(p.cfg().Name).Observe(p.since(start).Seconds())
+	p.imageCreatedAt = p.now()
+	p.logger().Info("prepared image", "operation", "prepare", "duration", p.since(start))
+	p.record(journal.Event{Type: journal.PrepareFinished, DurationSeconds: p.since(start).Seconds()})
+	return nil
+}
+
+func (p *pool) autoscale(ctx context.Context, checkPrepare bool, registered *registrations, pending int) (err error) {
+	ctx, span := p.startSpan(ctx, "pool.autoscale")
+	defer func() { tracing.End(span, err) }()
+	p.instances = nil
+	if p.paused.Load() {
+		if registered != nil {
+			// orphans are only reported if the instances of every pool are
+			// known
+			runners, err := p.cfg().Provider.ListRunners(ctx)
+			if err != nil {
+				return fmt.Errorf("list runners: %w", err)
+			}
+			p.setInstances(runners)
+		}
+		metrics, err := p.cfg().Provider.RunnerDisposition(ctx)
+		if err != nil {
+			return fmt.Errorf("get runner disposition: %w", err)
+		}
+		p.updateMetrics(metrics)
+		p.logger().Debug("scaling is paused")
+		return nil
+	}
+	force := p.forcePrepare.Swap(false)
+	if p.needsPrepareCheck.Swap(false) || checkPrepare || force {
+		err := p.maybePrepare(ctx, force)
+		if err != nil {
+			p.logger().Error("error when preparing", "operation", "prepare", "error", err)
+		}
+	}
+	runners, err := p.observeRunners(ctx, registered)
+	if err != nil {
+		p.logger().Error("error when observing runners", "operation", "reap", "error", err)
+	}
+	var metrics interfaces.RunnerDispositionMetrics
+	if registered != nil && p.instances != nil {
+		// the provider doesn't know the state reported by GitHub
+		metrics = countRunners(runners)
+	} else {
+		metrics, err = p.cfg().Provider.RunnerDisposition(ctx)
+		if err != nil {
+			return fmt.Errorf("get runner disposition: %w", err)
+		}
+	}
+
+	p.updateMetrics(metrics)
+
+	p.metrics.pendingJobs.WithLabelValues(p.cfg().Name).Set(float64(pending))
+
+	p.logger().Debug("status", "starting", metrics.StartingCount(), "idle", metrics.IdleCount(), "active", metrics.ActiveCount(), "total", metrics.TotalCount(), "pending", pending)
+	idleStartingCount := metrics.StartingCount() + metrics.IdleCount()
+	target := p.cfg().TargetIdle + pending
+
+	if idleStartingCount > target {
+		return p.maybeScaleDown(ctx, idleStartingCount-target, registered)
+	}
+	p.surplusSince = time.Time{}
+
+	createCount := p.createCount(metrics, target-idleStartingCount)
+	if createCount == 0 {
+		return nil
+	}
+	createCount, state := p.createBreaker.allow(p.now(), createCount, p.cfg().CreateBreakerThreshold, p.cfg().CreateBreakerCooldown)
+	p.metrics.createBreakerState.WithLabelValues(p.cfg().Name).Set(float64(state))
+	if createCount == 0 {
+		p.logger().Warn("create breaker is open, not creating instances", "breaker", state.String())
+		return nil
+	}
+	p.logger().Info("creating instances", "operation", "create", "count", createCount, "idle_starting", idleStartingCount, "target", target)
+	reason := fmt.Sprintf("%d idle or starting runners for target %d (target idle %d, pending jobs %d)", idleStartingCount, target, p.cfg().TargetIdle, pending)
+	return p.createRunners(ctx, createCount, reason)
+}
+
+// setInstances remembers the instances of the pool for checkOrphans
+func (p *pool) setInstances(runners []interfaces.Runner) {
+	p.instances = make(map[string]bool, len(runners))
+	for _, runner := range runners {
+		p.instances[runner.ID] = true
+	}
+}
+
+// observeRunners lists runners to record state changes and reap stuck
+// runners. The runners are returned with the state reported by GitHub if
+// registered is set.
+func (p *pool) observeRunners(ctx context.Context, registered *registrations) ([]interfaces.Runner, error) {
+	runners, err := p.cfg().Provider.ListRunners(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list runners: %w", err)
+	}
+	runners = registered.apply(runners)
+	if registered != nil {
+		p.setInstances(runners)
+		if registered.fresh {
+			p.checkRegistrations(runners, registered)
+		}
+	}
+	// transitions use activeSince from before this observation
+	p.recordTransitions(runners)
+	p.updateActiveSince(runners)
+	return runners, p.reapRunners(ctx, runners)
+}
+
+// recordTransitions records runners which changed state or disappeared since
+// the last observation
+func (p *pool) recordTransitions(runners []interfaces.Runner) {
+	p.observedMu.Lock()
+	defer p.observedMu.Unlock()
+	observed := make(map[string]interfaces.RunnerState)
+	for _, runner := range runners {
+		observed[runner.ID] = runner.State
+		if p.observed[runner.ID] == runner.State {
+			continue
+		}
+		switch runner.State {
+		case interfaces.RunnerStateStarting:
+			p.record(journal.Event{Type: journal.RunnerStarting, Instance: runner.ID})
+		case interfaces.RunnerStateIdle:
+			p.record(journal.Event{Type: journal.RunnerIdle, Instance: runner.ID})
+			// runners seen for the first time may have been idle for a while
+			if p.observed != nil && !runner.CreatedAt.IsZero() {
+				idleAt := runner.LastStateChange
+				if idleAt.IsZero() {
+					idleAt = p.now()
+				}
+				p.metrics.timeToIdle.WithLabelValues(p.cfg().Name).Observe(idleAt.Sub(runner.CreatedAt).Seconds())
+			}
+		case interfaces.RunnerStateActive:
+			p.record(journal.Event{Type: journal.RunnerActive, Instance: runner.ID})
+		}
+	}
+	for id, state := range p.observed {
+		if _, ok := observed[id]; ok {
+			continue
+		}
+		// runners we delete are removed from observed so these are gone on
+		// their own
+		if state == interfaces.RunnerStateActive {
+			p.record(journal.Event{Type: journal.RunnerFinished, Instance: id})
+			if activeSince, ok := p.activeSince[id]; ok {
+				p.metrics.jobDuration.WithLabelValues(p.cfg().Name).Observe(p.since(activeSince).Seconds())
+			}
+		} else {
+			p.record(journal.Event{Type: journal.RunnerDeleted, Instance: id, Reason: "instance disappeared"})
+		}
+	}
+	p.observed = observed
+}
+
+// reapRunners deletes runners which have been starting for longer than
+// StartingTimeout or active for longer than MaxActiveDuration. Stuck starting
+// runners are usually instances where cloud-init or config.sh failed. Runners
+// without a creation time are never reaped for starting too long.
+func (p *pool) reapRunners(ctx context.Context, runners []interfaces.Runner) error {
+	var errs []error
+	for _, runner := range runners {
+		switch {
+		case runner.State == interfaces.RunnerStateStarting && p.cfg().StartingTimeout > 0 && !runner.CreatedAt.IsZero() && p.since(runner.CreatedAt) > p.cfg().StartingTimeout:
+			p.logger().Info("reaping instance which is stuck starting", "operation", "reap", "instance", runner.ID, "created_at", runner.CreatedAt)
+			err := p.reapRunner(ctx, runner.ID, "starting timeout")
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			p.metrics.reapedRunners.WithLabelValues(p.cfg().Name).Inc()
+		case runner.State == interfaces.RunnerStateActive && p.cfg().MaxActiveDuration > 0 && p.since(p.activeSince[runner.ID]) > p.cfg().MaxActiveDuration:
+			p.logger().Info("deleting instance which exceeded the max active duration", "operation", "reap", "instance", runner.ID, "active_since", p.activeSince[runner.ID])
+			err := p.reapRunner(ctx, runner.ID, "max active duration")
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			p.metrics.activeTimeouts.WithLabelValues(p.cfg().Name).Inc()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// updateActiveSince records when runners became active. If the provider
+// doesn't know when the state changed, we use when we first saw it active.
+func (p *pool) updateActiveSince(runners []interfaces.Runner) {
+	active := make(map[string]bool)
+	for _, runner := range runners {
+		if runner.State != interfaces.RunnerStateActive {
+			continue
+		}
+		active[runner.ID] = true
+		if _, ok := p.activeSince[runner.ID]; ok {
+			continue
+		}
+		if !runner.LastStateChange.IsZero() {
+			p.activeSince[runner.ID] = runner.LastStateChange
+		} else {
+			p.activeSince[runner.ID] = p.now()
+		}
+	}
+	for id := range p.activeSince {
+		if !active[id] {
+			delete(p.activeSince, id)
+		}
+	}
+}
+
+func (p *pool) reapRunner(ctx context.Context, id, reason string) error {
+	p.record(journal.Event{Type: journal.RunnerReaped, Instance: id, Reason: reason})
+	// the runner may be registered even if it never became idle
+	return p.deleteRunners(ctx, []string{id}, interfaces.DeleteForce, true, reason)
+}
+
+// createRunners creates count runners with up to CreateConcurrency in
+// parallel. A failure does not abort the remaining creations.
+func (p *pool) createRunners(ctx context.Context, count int, reason string) error {
+	sem := make(chan struct{}, max(p.cfg().CreateConcurrency, 1))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for i := 0; i < count; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := p.createRunner(ctx, reason)
+			p.recordCreate(err)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				return
+			}
+			p.metrics.runnersCreated.WithLabelValues(p.cfg().Name).Inc()
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		p.logger().Warn("created some instances", "operation", "create", "created", count-len(errs), "count", count)
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// recordCreate updates the create breaker and logs when it changes state
+func (p *pool) recordCreate(err error) {
+	// the context being canceled says nothing about the provider
+	if errors.Is(err, context.Canceled) {
+		p.createBreaker.release()
+		return
+	}
+	state, changed := p.createBreaker.record(p.now(), err, p.cfg().CreateBreakerThreshold)
+	if changed {
+		p.logger().Warn("create breaker changed", "breaker", state.String())
+	}
+	p.metrics.createBreakerState.WithLabelValues(p.cfg().Name).Set(float64(state))
+}
+
+func (p *pool) createRunner(ctx context.Context, reason string) (err error) {
+	ctx, span := p.startSpan(ctx, "createRunner")
+	defer func() { tracing.End(span, err) }()
+	requestID := newRequestID()
+	span.SetAttributes(attribute.String("request_id", requestID))
+	p.record(journal.Event{Type: journal.RunnerRequested, RequestID: requestID, Reason: reason})
+	start := p.now()
+	url := p.tokenProvider.URL()
+	tokenCtx, tokenSpan := p.startSpan(ctx, "token")
+	token, err := p.tokenProvider.Token(tokenCtx)
+	tracing.End(tokenSpan, err)
+	p.metrics.tokenDuration.WithLabelValues(p.cfg().Name).Observe(p.since(start).Seconds())
+	if err != nil {
+		p.metrics.createFailures.WithLabelValues(p.cfg().Name, "token").Inc()
+		p.record(journal.Event{Type: journal.RunnerCreateFailed, RequestID: requestID, Reason: reason, Error: err.Error()})
+		return fmt.Errorf("get runner token: %w", err)
+	}
+	createStart := p.now()
+	id, err := p.cfg().Provider.CreateRunner(ctx, url, token, p.cfg().Labels)
+	p.metrics.createDuration.WithLabelValues(p.cfg().Name).Observe(p.since(createStart).Seconds())
+	if err != nil {
+		p.metrics.createFailures.WithLabelValues(p.cfg().Name, "provider").Inc()
+		p.logger().Error("error when creating instance", "operation", "create", "instance", id, "request_id", requestID, "duration", p.since(start), "error", err)
+		p.record(journal.Event{Type: journal.RunnerCreateFailed, Instance: id, RequestID: requestID, Reason: reason, Error: err.Error(), DurationSeconds: p.since(start).Seconds()})
+		return fmt.Errorf("create runner: %w", err)
+	}
+	p.logger().Info("created instance", "operation", "create", "instance", id, "request_id", requestID, "duration", p.since(start))
+	p.record(journal.Event{Type: journal.RunnerCreated, Instance: id, RequestID: requestID, Reason: reason, DurationSeconds: p.since(start).Seconds()})
+	return nil
+}
+
+// newRequestID returns an ID which correlates the events of a runner creation
+func newRequestID() string {
+	return strconv.FormatUint(rand.Uint64(), 36)
+}
+
+// createCount limits the number of runners needed by the configured
+// capacity limits
+func (p *pool) createCount(metrics interfaces.RunnerDispositionMetrics, needed int) int {
+	count := needed
+	if p.cfg().MaxTotal > 0 {
+		count = min(count, p.cfg().MaxTotal-metrics.TotalCount())
+	}
+	if p.cfg().MaxStarting > 0 {
+		count = min(count, p.cfg().MaxStarting-metrics.StartingCount())
+	}
+	if p.cfg().MaxCreatePerTick > 0 {
+		count = min(count, p.cfg().MaxCreatePerTick)
+	}
+	count = max(count, 0)
+	if count < needed {
+		p.logger().Info("capacity limits reached", "count", count, "needed", needed)
+	}
+	return count
+}
+
+// maybeScaleDown deletes surplus idle runners once there has been a surplus
+// for longer than ScaleDownDelay
+func (p *pool) maybeScaleDown(ctx context.Context, surplus int, registered *registrations) error {
+	if p.surplusSince.IsZero() {
+		p.surplusSince = p.now()
+	}
+	if p.since(p.surplusSince) < p.cfg().ScaleDownDelay {
+		return nil
+	}
+	runners, err := p.cfg().Provider.ListRunners(ctx)
+	if err != nil {
+		return fmt.Errorf("list runners: %w", err)
+	}
+	runners = registered.apply(runners)
+	// prefer deleting idle runners since starting runners may be about to
+	// pick up a job
+	ids := runnerIDs(runners, interfaces.RunnerStateIdle)
+	ids = append(ids, runnerIDs(runners, interfaces.RunnerStateStarting)...)
+	ids = ids[:min(surplus, len(ids))]
+	p.logger().Info("deleting surplus instances", "operation", "scale_down", "count", len(ids))
+	err = p.deleteRunners(ctx, ids, interfaces.DeleteIfNotActive, true, "scale down")
+	if err != nil {
+		return err
+	}
+	p.surplusSince = time.Time{}
+	return nil
+}
+
+func runnerIDs(runners []interfaces.Runner, state interfaces.RunnerState) []string {
+	var ids []string
+	for _, runner := range runners {
+		if runner.State == state {
+			ids = append(ids, runner.ID)
+		}
+	}
+	return ids
+}
+
+// deleteRunners deletes runners by ID and deregisters the deleted ones from
+// GitHub so they don't linger as offline. Runners picked from a listing must
+// use DeleteIfNotActive since they may have taken a job since.
+func (p *pool) deleteRunners(ctx context.Context, ids []string, mode interfaces.DeleteMode, wait bool, reason string) (err error) {
+	ctx, span := p.startSpan(ctx, "deleteRunners", attribute.StringSlice("instances", ids), attribute.String("reason", reason))
+	defer func() { tracing.End(span, err) }()
+	if len(ids) == 0 {
+		return nil
+	}
+	start := p.now()
+	deleted, deleteErr := p.cfg().Provider.DeleteRunnersByID(ctx, ids, mode, wait)
+	// runners of instances which still exist must stay registered or they
+	// could never take a job
+	for _, id := range deleted {
+		err := p.tokenProvider.RemoveRunner(ctx, id)
+		if err != nil {
+			p.metrics.deleteFailures.WithLabelValues(p.cfg().Name, "deregister").Inc()
+			p.logger().Warn("error when removing runner", "operation", "delete", "instance", id, "error", err)
+		} else {
+			p.registrations.remove(id)
+		}
+		p.logger().Info("deleted instance", "operation", "delete", "instance", id, "duration", p.since(start))
+		p.record(journal.Event{Type: journal.RunnerDeleted, Instance: id, Reason: reason, DurationSeconds: p.since(start).Seconds()})
+		p.observedMu.Lock()
+		delete(p.observed, id)
+		p.observedMu.Unlock()
+	}
+	if len(deleted) < len(ids) && deleteErr == nil {
+		p.logger().Info("skipped instances which took a job", "operation", "delete", "instances", ids, "deleted", deleted)
+	}
+	if deleteErr != nil {
+		p.metrics.deleteFailures.WithLabelValues(p.cfg().Name, "provider").Inc()
+		p.logger().Error("error when deleting instances", "operation", "delete", "instances", ids, "deleted", deleted, "duration", p.since(start), "error", deleteErr)
+		return fmt.Errorf("delete runners: %w", deleteErr)
+	}
+	return nil
+}
+
+func (p *pool) cleanup(ctx context.Context, registered *registrations) error {
+	runners, err := p.cfg().Provider.ListRunners(ctx)
+	if err != nil {
+		return fmt.Errorf("list runners: %w", err)
+	}
+	runners = registered.apply(runners)
+	ids := runnerIDs(runners, interfaces.RunnerStateIdle)
+	ids = append(ids, runnerIDs(runners, interfaces.RunnerStateStarting)...)
+	return p.deleteRunners(ctx, ids, interfaces.DeleteIfNotActive, false, "cleanup")
+}
@@ -0,0 +1,220 @@
+package autoscaler
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/tracing"
+)
+
+// registrationsMaxAge is how long the registered runners are reused. Listing
+// them every iteration would exhaust the GitHub rate limit.
+const registrationsMaxAge = time.Second * 30
+
+// registrations are the runners registered with GitHub by name. It is nil
+// when there is no registry or listing failed, in which case the state
+// reported by the provider is used.
+type registrations struct {
+	runners map[string]interfaces.RegisteredRunner
+	// fresh is set if the runners were listed for this iteration. Cached
+	// runners may have taken a job since, so they never make a runner idle
+	// and aren't used to report mismatches.
+	fresh bool
+}
+
+// registrationCache lists the registered runners at most every
+// registrationsMaxAge
+type registrationCache struct {
+	registry RunnerRegistry
+	now      func() time.Time
+	logger   *slog.Logger
+
+	mu       sync.Mutex
+	runners  map[string]interfaces.RegisteredRunner
+	listedAt time.Time
+}
+
+func (c *registrationCache) get(ctx context.Context) *registrations {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.listedAt.IsZero() && c.now().Sub(c.listedAt) < registrationsMaxAge {
+		if c.runners == nil {
+			return nil
+		}
+		return &registrations{runners: c.runners}
+	}
+	// failures are cached too so that we don't retry every iteration
+	c.listedAt = c.now()
+	c.runners = nil
+	ctx, span := tracer.Start(ctx, "registeredRunners")
+	runners, err := c.registry.RegisteredRunners(ctx)
+	tracing.End(span, err)
+	if err != nil {
+		c.logger.Warn("error when listing registered runners, using the provider state", "retry_in", registrationsMaxAge, "error", err)
+		return nil
+	}
+	c.runners = make(map[string]interfaces.RegisteredRunner, len(runners))
+	for _, runner := range runners {
+		c.runners[runner.Name] = runner
+	}
+	return &registrations{runners: c.runners, fresh: true}
+}
+
+// remove forgets a deregistered runner. The map is replaced since it may be
+// read by an iteration.
+func (c *registrationCache) remove(name string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.runners[name]; !ok {
+		return
+	}
+	runners := maps.Clone(c.runners)
+	delete(runners, name)
+	c.runners = runners
+}
+
+// apply replaces the state of runners with the state GitHub reports for
+// online runners. Other runners keep the state reported by the provider.
+func (r *registrations) apply(runners []interfaces.Runner) []interfaces.Runner {
+	if r == nil {
+		return runners
+	}
+	res := make([]interfaces.Runner, 0, len(runners))
+	for _, runner := range runners {
+		registered, ok := r.runners[runner.ID]
+		if ok && registered.Status == "online" && runner.State != interfaces.RunnerStateStopped {
+			state := interfaces.RunnerStateIdle
+			if registered.Busy {
+				state = interfaces.RunnerStateActive
+			}
+			if state == interfaces.RunnerStateIdle && !r.fresh {
+				state = runner.State
+			}
+			if state != runner.State {
+				runner.State = state
+				// we don't know when GitHub saw the change
+				runner.LastStateChange = time.Time{}
+			}
+		}
+		res = append(res, runner)
+	}
+	return res
+}
+
+// checkRegistrations reports instances which are past starting but have no
+// registered runner
+func (p *pool) checkRegistrations(runners []interfaces.Runner, registered *registrations) {
+	unregistered := make(map[string]bool)
+	for _, runner := range runners {
+		// runners register during starting and deregister before stopping
+		switch runner.State {
+		case interfaces.RunnerStateStarting, interfaces.RunnerStateStopped, interfaces.RunnerStateUnknown:
+			continue
+		}
+		if _, ok := registered.runners[runner.ID]; ok {
+			continue
+		}
+		unregistered[runner.ID] = true
+		if !p.unregistered[runner.ID] {
+			p.logger().Warn("instance has no registered runner", "operation", "reconcile", "instance", runner.ID, "state", runner.State)
+		}
+	}
+	p.unregistered = unregistered
+	p.metrics.unregisteredInstances.WithLabelValues(p.cfg().Name).Set(float64(len(unregistered)))
+}
+
+// checkOrphans reports registered runners which have no instance. Runners
+// are attributed to the pool with the most labels they have so that runners
+// which aren't managed by us are ignored. Nothing is reported unless the
+// instances of every pool are known.
+func (a *Autoscaler) checkOrphans(registered *registrations) {
+	pools := a.getPools()
+	for _, p := range pools {
+		if p.instances == nil {
+			return
+		}
+	}
+	orphaned := make(map[*pool]map[string]bool)
+	for name, runner := range registered.runners {
+		var owner *pool
+		for _, p := range pools {
+			if p.instances[name] {
+				owner = nil
+				break
+			}
+			if hasLabels(runner.Labels, p.cfg().Labels) && (owner == nil || labelCount(p) > labelCount(owner)) {
+				owner = p
+			}
+		}
+		if owner == nil {
+			continue
+		}
+		if orphaned[owner] == nil {
+			orphaned[owner] = make(map[string]bool)
+		}
+		orphaned[owner][name] = true
+		if !owner.orphaned[name] {
+			owner.logger().Warn("registered runner has no instance", "operation", "reconcile", "runner", name, "status", runner.Status)
+		}
+	}
+	for _, p := range pools {
+		p.orphaned = orphaned[p]
+		p.metrics.orphanedRunners.WithLabelValues(p.cfg().Name).Set(float64(len(p.orphaned)))
+	}
+}
+
+func labelCount(p *pool) int {
+	return len(strings.Split(p.cfg().Labels, ","))
+}
+
+// hasLabels returns true if runnerLabels contains every label of the comma
+// separated poolLabels
+func hasLabels(runnerLabels []string, poolLabels string) bool {
+	available := make(map[string]bool, len(runnerLabels))
+	for _, label := range runnerLabels {
+		available[strings.ToLower(label)] = true
+	}
+	for _, label := range strings.Split(poolLabels, ",") {
+		if !available[strings.ToLower(strings.TrimSpace(label))] {
+			return false
+		}
+	}
+	return true
+}
+
+// runnerCounts implements interfaces.RunnerDispositionMetrics for reconciled
+// runners. Stopped runners are only part of the total.
+type runnerCounts struct {
+	total, starting, idle, active int
+}
+
+func countRunners(runners []interfaces.Runner) runnerCounts {
+	counts := runnerCounts{total: len(runners)}
+	for _, runner := range runners {
+		switch runner.State {
+		case interfaces.RunnerStateStarting, interfaces.RunnerStateUnknown:
+			counts.starting++
+		case interfaces.RunnerStateIdle:
+			counts.idle++
+		case interfaces.RunnerStateActive:
+			counts.active++
+		}
+	}
+	return counts
+}
+
+func (c runnerCounts) TotalCount() int    { return c.total }
+func (c runnerCounts) StartingCount() int { return c.starting }
+func (c runnerCounts) IdleCount() int     { return c.idle }
+func (c runnerCounts) ActiveCount() int   { return c.active }
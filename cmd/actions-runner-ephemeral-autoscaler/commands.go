@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/autoscaler"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/config"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/common"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/gcp"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/githubrunners"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/githubtoken"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/lxd"
+	"github.com/google/go-github/v68/github"
+	"golang.org/x/oauth2"
+)
+
+// commandEnv is the parsed config passed to every command
+type commandEnv struct {
+	configPath string
+	cfg        *config.Config
+	logLevel   *slog.LevelVar
+}
+
+type command struct {
+	name  string
+	usage string
+	// flags registers command specific flags and returns the command
+	flags func(fs *flag.FlagSet) func(ctx context.Context, env commandEnv) error
+}
+
+var commands = []command{
+	{
+		name:  "run",
+		usage: "Scale runners until stopped (default)",
+		flags: func(fs *flag.FlagSet) func(context.Context, commandEnv) error {
+			return runAutoscaler
+		},
+	},
+	{
+		name:  "status",
+		usage: "Print the runners of each pool by state",
+		flags: statusFlags,
+	},
+	{
+		name:  "prepare",
+		usage: "Prepare a new image for each pool and exit",
+		flags: prepareFlags,
+	},
+	{
+		name:  "cleanup",
+		usage: "Delete idle and starting runners and exit",
+		flags: cleanupFlags,
+	},
+	{
+		name:  "list-images",
+		usage: "Print the images of each pool",
+		flags: listImagesFlags,
+	},
+	{
+		name:  "render-cloud-init",
+		usage: "Print the cloud-init used to prepare images or start runners",
+		flags: renderCloudInitFlags,
+	},
+}
+
+func main() {
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == name {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %s\n\n", name)
+		printCommands()
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags]\n\n%s\n\n", os.Args[0], cmd.name, cmd.usage)
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output())
+		printCommands()
+	}
+	run := cmd.flags(fs)
+	configPath, cfg, err := parseFlags(fs, args)
+	if configPath != "" {
+		cfg, err = config.Load(configPath)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	logLevel := setupLogging(cfg.Log)
+
+	err = run(context.Background(), commandEnv{
+		configPath: configPath,
+		cfg:        cfg,
+		logLevel:   logLevel,
+	})
+	if err != nil {
+		slog.Error(cmd.name+" failed", "error", err)
+		os.Exit(2)
+	}
+}
+
+func printCommands() {
+	fmt.Fprintln(os.Stderr, "Commands:")
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", cmd.name, cmd.usage)
+	}
+	w.Flush()
+}
+
+func newGitHubClient(ctx context.Context, cfg *config.Config) *github.Client {
+	githubToken := cfg.GitHub.Token
+	if githubToken == "" {
+		githubToken = os.Getenv("GITHUB_TOKEN")
+	}
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: githubToken})
+	tc := oauth2.NewClient(ctx, ts)
+	return github.NewClient(tc)
+}
+
+func newTokenProvider(client *github.Client, cfg *config.Config) *githubtoken.RepoProvider {
+	return &githubtoken.RepoProvider{
+		Client: client,
+		Org:    cfg.GitHub.Org,
+		Repo:   cfg.GitHub.Repo,
+	}
+}
+
+// newRunnerRegistry returns nil unless runners are reconciled with GitHub
+func newRunnerRegistry(client *github.Client, cfg *config.Config) autoscaler.RunnerRegistry {
+	if !cfg.GitHub.ReconcileRunners {
+		return nil
+	}
+	return &githubrunners.Registry{
+		Client: client,
+		Org:    cfg.GitHub.Org,
+		Repo:   cfg.GitHub.Repo,
+	}
+}
+
+// selectPools adds the -only-pool flag which limits a command to a single
+// pool. The returned function filters the configured pools.
+func selectPools(fs *flag.FlagSet) func(cfg *config.Config) ([]config.Pool, error) {
+	only := fs.String("only-pool", "", "Only use the pool with this name (all pools if empty)")
+	return func(cfg *config.Config) ([]config.Pool, error) {
+		if *only == "" {
+			return cfg.Pools, nil
+		}
+		for _, pool := range cfg.Pools {
+			if pool.Name == *only {
+				return []config.Pool{pool}, nil
+			}
+		}
+		return nil, fmt.Errorf("pool %s is not configured", *only)
+	}
+}
+
+// buildPools builds the selected pools
+func buildPools(cfg *config.Config, selected []config.Pool) ([]autoscaler.PoolConfig, error) {
+	selectedCfg := *cfg
+	selectedCfg.Pools = selected
+	return newPoolBuilder().build(&selectedCfg)
+}
+
+func statusFlags(fs *flag.FlagSet) func(context.Context, commandEnv) error {
+	selected := selectPools(fs)
+	return func(ctx context.Context, env commandEnv) error {
+		pools, err := selected(env.cfg)
+		if err != nil {
+			return err
+		}
+		poolConfigs, err := buildPools(env.cfg, pools)
+		if err != nil {
+			return err
+		}
+		a := autoscaler.New(nil, autoscaler.AutoscalerConfig{Pools: poolConfigs})
+		statuses, err := a.Pools(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "POOL\tPROVIDER\tLABELS\tTARGET IDLE\tSTARTING\tIDLE\tACTIVE\tTOTAL")
+		for _, status := range statuses {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n", status.Name, status.Provider, strings.Join(status.Labels, ","), status.TargetIdle, status.Starting, status.Idle, status.Active, status.Total)
+		}
+		return w.Flush()
+	}
+}
+
+func prepareFlags(fs *flag.FlagSet) func(context.Context, commandEnv) error {
+	selected := selectPools(fs)
+	return func(ctx context.Context, env commandEnv) error {
+		pools, err := selected(env.cfg)
+		if err != nil {
+			return err
+		}
+		poolConfigs, err := buildPools(env.cfg, pools)
+		if err != nil {
+			return err
+		}
+		for _, pool := range poolConfigs {
+			slog.Info("preparing image", "pool", pool.Name, "provider", pool.ProviderName)
+			start := time.Now()
+			err := pool.Provider.PrepareImage(ctx, pool.PrepareOptions)
+			if err != nil {
+				return fmt.Errorf("pool %s: prepare image: %w", pool.Name, err)
+			}
+			slog.Info("prepared image", "pool", pool.Name, "provider", pool.ProviderName, "duration", time.Since(start))
+		}
+		return nil
+	}
+}
+
+func cleanupFlags(fs *flag.FlagSet) func(context.Context, commandEnv) error {
+	selected := selectPools(fs)
+	return func(ctx context.Context, env commandEnv) error {
+		pools, err := selected(env.cfg)
+		if err != nil {
+			return err
+		}
+		poolConfigs, err := buildPools(env.cfg, pools)
+		if err != nil {
+			return err
+		}
+		// deleted runners are also deregistered from GitHub
+		githubClient := newGitHubClient(ctx, env.cfg)
+		a := autoscaler.New(newTokenProvider(githubClient, env.cfg), autoscaler.AutoscalerConfig{
+			Pools:          poolConfigs,
+			RunnerRegistry: newRunnerRegistry(githubClient, env.cfg),
+		})
+		return a.Cleanup(ctx)
+	}
+}
+
+func listImagesFlags(fs *flag.FlagSet) func(context.Context, commandEnv) error {
+	selected := selectPools(fs)
+	return func(ctx context.Context, env commandEnv) error {
+		pools, err := selected(env.cfg)
+		if err != nil {
+			return err
+		}
+		poolConfigs, err := buildPools(env.cfg, pools)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "POOL\tIMAGE\tCREATED\tAGE\tCURRENT")
+		for _, pool := range poolConfigs {
+			images, err := pool.Provider.ListImages(ctx)
+			if err != nil {
+				return fmt.Errorf("pool %s: %w", pool.Name, err)
+			}
+			for _, image := range images {
+				current := ""
+				if image.Current {
+					current = "*"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", pool.Name, image.ID, image.CreatedAt.Format(time.RFC3339), time.Since(image.CreatedAt).Round(time.Minute), current)
+			}
+		}
+		return w.Flush()
+	}
+}
+
+func renderCloudInitFlags(fs *flag.FlagSet) func(context.Context, commandEnv) error {
+	selected := selectPools(fs)
+	kind := fs.String("kind", "prepare", "Which cloud-init to render (prepare|start)")
+	token := fs.String("registration-token", "REGISTRATION_TOKEN", "Registration token to render in the start cloud-init")
+	return func(ctx context.Context, env commandEnv) error {
+		pools, err := selected(env.cfg)
+		if err != nil {
+			return err
+		}
+		for _, pool := range pools {
+			var rendered string
+			switch *kind {
+			case "prepare":
+				prepareOpts, err := readPrepareOptions(pool.CustomCloudInit)
+				if err != nil {
+					return err
+				}
+				if pool.Provider == "gcp" {
+					rendered, err = gcp.CloudInitPrepare(ctx, prepareOpts)
+				} else {
+					rendered, err = lxd.CloudInitPrepare(ctx, prepareOpts)
+				}
+				if err != nil {
+					return fmt.Errorf("pool %s: render cloud-init: %w", pool.Name, err)
+				}
+			case "start":
+				url := newTokenProvider(nil, env.cfg).URL()
+				rendered = common.GetCloudInitStart(url, *token, strings.Join(pool.Labels, ","))
+			default:
+				return fmt.Errorf("invalid kind %s, options are prepare|start", *kind)
+			}
+			if len(pools) > 1 {
+				fmt.Printf("# pool: %s\n", pool.Name)
+			}
+			fmt.Print(rendered)
+		}
+		return nil
+	}
+}
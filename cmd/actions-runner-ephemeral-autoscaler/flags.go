@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/config"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+)
+
+// poolFlag is a repeatable flag. Each value is a semicolon separated list of
+// key=value pool settings:
+//
+//	-pool 'name=lint;provider=lxd;labels=lint,small;target-idle=1'
+type poolFlag []map[string]string
+
+var poolSettingKeys = []string{"name", "provider", "labels", "arch", "target-idle", "max-total", "max-starting", "max-create-per-tick", "custom-cloud-init"}
+
+func (f *poolFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *poolFlag) Set(value string) error {
+	settings := make(map[string]string)
+	for _, pair := range strings.Split(value, ";") {
+		key, val, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid pool setting %q, expected key=value", pair)
+		}
+		key = strings.TrimSpace(key)
+		if !isPoolSettingKey(key) {
+			return fmt.Errorf("unknown pool setting %q, options are %s", key, strings.Join(poolSettingKeys, "|"))
+		}
+		settings[key] = strings.TrimSpace(val)
+	}
+	*f = append(*f, settings)
+	return nil
+}
+
+func isPoolSettingKey(key string) bool {
+	for _, k := range poolSettingKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// poolFromSettings creates a pool from -pool settings. Settings which are not
+// provided are copied from defaults.
+func poolFromSettings(settings map[string]string, defaults config.Pool) (config.Pool, error) {
+	pool := defaults
+	pool.Name = settings["name"]
+	pool.Labels = nil
+	if settings["labels"] != "" {
+		pool.Labels = strings.Split(settings["labels"], ",")
+	}
+	if provider, ok := settings["provider"]; ok {
+		pool.Provider = provider
+	}
+	if arch, ok := settings["arch"]; ok {
+		pool.Arch = arch
+	}
+	if customCloudInit, ok := settings["custom-cloud-init"]; ok {
+		pool.CustomCloudInit = customCloudInit
+	}
+
+	ints := []struct {
+		key    string
+		target *int
+	}{
+		{"target-idle", &pool.TargetIdle},
+		{"max-total", &pool.MaxTotal},
+		{"max-starting", &pool.MaxStarting},
+		{"max-create-per-tick", &pool.MaxCreatePerTick},
+	}
+	for _, field := range ints {
+		val, ok := settings[field.key]
+		if !ok {
+			continue
+		}
+		parsed, err := strconv.Atoi(val)
+		if err != nil {
+			return pool, fmt.Errorf("pool %s: %s: %w", pool.Name, field.key, err)
+		}
+		*field.target = parsed
+	}
+	return pool, nil
+}
+
+// parseFlags parses args into a config with the flags shared by every
+// command. configPath is set if the config should be loaded from a file
+// instead.
+func parseFlags(fs *flag.FlagSet, args []string) (configPath string, cfg *config.Config, err error) {
+	defaults := config.DefaultPool()
+
+	fs.StringVar(&configPath, "config", "", "Path to a YAML config file which is reloaded on SIGHUP or change. Other flags are ignored when set.")
+	org := fs.String("org", os.Getenv("GITHUB_ORG"), "GitHub organization name")
+	repo := fs.String("repo", os.Getenv("GITHUB_REPO"), "GitHub repository name")
+	labels := fs.String("labels", "", "Runner labels")
+	fs.StringVar(&defaults.Arch, "arch", defaults.Arch, "Architecture label of the runners (x64|x86|arm64|arm)")
+	fs.IntVar(&defaults.TargetIdle, "target-idle", defaults.TargetIdle, "Target number of idle runners")
+	fs.IntVar(&defaults.MaxTotal, "max-total", defaults.MaxTotal, "Maximum number of runners (0 is unlimited)")
+	fs.IntVar(&defaults.MaxStarting, "max-starting", defaults.MaxStarting, "Maximum number of runners starting at once (0 is unlimited)")
+	fs.IntVar(&defaults.MaxCreatePerTick, "max-create-per-tick", defaults.MaxCreatePerTick, "Maximum number of runners created per autoscale iteration (0 is unlimited)")
+	fs.IntVar(&defaults.CreateConcurrency, "create-concurrency", defaults.CreateConcurrency, "Number of runners created in parallel")
+	fs.DurationVar(&defaults.StartingTimeout, "starting-timeout", defaults.StartingTimeout, "Delete runners which have not become idle after this long (0 disables)")
+	fs.DurationVar(&defaults.MaxActiveDuration, "max-active-duration", defaults.MaxActiveDuration, "Delete runners which have been running a job for longer than this (0 disables)")
+	fs.DurationVar(&defaults.ScaleDownDelay, "scale-down-delay", defaults.ScaleDownDelay, "How long surplus idle runners are kept before they are deleted")
+	fs.IntVar(&defaults.CreateBreakerThreshold, "create-breaker-threshold", defaults.CreateBreakerThreshold, "Stop creating runners after this many consecutive failures (0 disables)")
+	fs.DurationVar(&defaults.CreateBreakerCooldown, "create-breaker-cooldown", defaults.CreateBreakerCooldown, "How long runner creation is stopped before a probe runner is created")
+	fs.StringVar(&defaults.CustomCloudInit, "custom-cloud-init", "", "Path to custom cloud init file")
+	fs.StringVar(&defaults.Provider, "provider", defaults.Provider, "Provider to use (lxd|gcp)")
+	pollInterval := fs.Duration("poll-interval", 0, "Interval to poll GitHub for queued jobs when webhooks are not available (polling is disabled if 0)")
+	reconcileRunners := fs.Bool("reconcile-runners", false, "Use the runners registered with GitHub to decide whether runners are idle or active")
+	sigtermLeaveRunners := fs.Bool("sigterm-leave-runners", false, "Exit immediately on SIGTERM and leave all runners running (useful for rolling restarts)")
+	drainTimeout := fs.Duration("drain-timeout", 0, "How long to wait for active runners to finish on SIGTERM (0 does not wait)")
+	journalPath := fs.String("journal", "", "File to append runner lifecycle events to as JSON lines, or - for stdout (disabled if empty)")
+	var leaderElection config.LeaderElection
+	fs.StringVar(&leaderElection.Type, "leader-election", "none", "Where to elect a leader when running multiple replicas (none|file|lxd|gcp)")
+	fs.StringVar(&leaderElection.LockFile, "leader-lock-file", "", "Path of the lock file for -leader-election=file")
+	fs.StringVar(&leaderElection.GCSBucket, "leader-gcs-bucket", "", "GCS bucket of the lease for -leader-election=gcp")
+	fs.DurationVar(&leaderElection.LeaseDuration, "leader-lease-duration", 15*time.Second, "How long until another replica may take over from a leader which stopped renewing")
+	fs.StringVar(&leaderElection.Identity, "leader-id", "", "Unique identity of this replica (defaults to hostname and pid)")
+	var logCfg config.Log
+	fs.StringVar(&logCfg.Level, "log-level", "info", "Minimum log level (debug|info|warn|error)")
+	fs.StringVar(&logCfg.Format, "log-format", "text", "Log output format (text|json)")
+	var tracingCfg config.Tracing
+	fs.StringVar(&tracingCfg.Endpoint, "otlp-endpoint", "", "OTLP/HTTP endpoint to export traces to as host:port or a URL (tracing is disabled if empty)")
+	fs.BoolVar(&tracingCfg.Insecure, "otlp-insecure", false, "Disable TLS for -otlp-endpoint")
+	fs.Float64Var(&tracingCfg.SampleRatio, "trace-sample-ratio", 1, "Fraction of autoscale iterations which are traced")
+	adminToken := fs.String("admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token for the admin API on /api/v1/ (disabled if empty)")
+	webhookSecret := fs.String("webhook-secret", os.Getenv("GITHUB_WEBHOOK_SECRET"), "Secret for workflow_job webhooks received on /webhook (webhook is disabled if empty)")
+	var poolSettings poolFlag
+	fs.Var(&poolSettings, "pool", "Add a runner pool as semicolon separated key=value settings (keys: name, provider, labels, arch, target-idle, max-total, max-starting, max-create-per-tick, custom-cloud-init). Unset keys use the global flags. May be repeated. -labels is not required when set.")
+	fs.Parse(args)
+
+	if configPath != "" {
+		return configPath, nil, nil
+	}
+	if *org == "" || *repo == "" || (*labels == "" && len(poolSettings) == 0) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	cfg = &config.Config{
+		GitHub: config.GitHub{
+			Org:              *org,
+			Repo:             *repo,
+			WebhookSecret:    *webhookSecret,
+			PollInterval:     *pollInterval,
+			ReconcileRunners: *reconcileRunners,
+		},
+		Log:     logCfg,
+		Tracing: tracingCfg,
+		Admin:   config.Admin{Token: *adminToken},
+		Autoscaler: config.Autoscaler{
+			DrainTimeout:        *drainTimeout,
+			SigtermLeaveRunners: *sigtermLeaveRunners,
+			LeaderElection:      leaderElection,
+			Journal:             *journalPath,
+		},
+	}
+	if len(poolSettings) == 0 {
+		pool := defaults
+		pool.Name = interfaces.DefaultPool
+		pool.Labels = strings.Split(*labels, ",")
+		cfg.Pools = append(cfg.Pools, pool)
+	}
+	for _, settings := range poolSettings {
+		pool, err := poolFromSettings(settings, defaults)
+		if err != nil {
+			return "", nil, err
+		}
+		cfg.Pools = append(cfg.Pools, pool)
+	}
+	return "", cfg, cfg.Validate()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/config"
+)
+
+// setupLogging sets the default slog logger. The returned level can be
+// changed when the config is reloaded.
+func setupLogging(cfg config.Log) *slog.LevelVar {
+	level := &slog.LevelVar{}
+	level.Set(parseLevel(cfg.Level))
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if cfg.Format == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	// also routes log.Printf from dependencies through the handler
+	slog.SetDefault(slog.New(handler))
+	return level
+}
+
+// parseLevel parses a level which has already been validated
+func parseLevel(value string) slog.Level {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(value))
+	if err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
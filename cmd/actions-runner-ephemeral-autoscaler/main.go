@@ -2,116 +2,301 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/admin"
 	"github.com/gartnera/actions-runner-ephemeral-autoscaler/autoscaler"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/config"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/journal"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/leader"
 	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/gcp"
-	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/githubtoken"
-	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/githubdemand"
 	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/lxd"
-	"github.com/google/go-github/v68/github"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/tracing"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"golang.org/x/oauth2"
 )
 
-func main() {
-	org := flag.String("org", os.Getenv("GITHUB_ORG"), "GitHub organization name")
-	repo := flag.String("repo", os.Getenv("GITHUB_REPO"), "GitHub repository name")
-	labels := flag.String("labels", "", "Runner labels")
-	targetIdle := flag.Int("target-idle", 1, "Target number of idle runners")
-	customCloudInitPath := flag.String("custom-cloud-init", "", "Path to custom cloud init file")
-	providerName := flag.String("provider", "lxd", "Provider to use (only 'lxd' supported)")
-	flag.Parse()
-
-	if *org == "" || *repo == "" || *labels == "" {
-		flag.Usage()
-		os.Exit(1)
+// runAutoscaler is the run command which scales runners until it is stopped
+// by a signal
+func runAutoscaler(ctx context.Context, env commandEnv) error {
+	cfg, configPath := env.cfg, env.configPath
+	poolBuilder := newPoolBuilder()
+	pools, err := poolBuilder.build(cfg)
+	if err != nil {
+		return err
 	}
 
-	var provider interfaces.Provider
-	var err error
-
-	ctx := context.Background()
-	switch *providerName {
-	case "lxd":
-		provider, err = lxd.New()
-	case "gcp":
-		provider, err = gcp.New()
-	default:
-		fmt.Printf("Invalid provider %s, options are lxd|gcp", *providerName)
-		os.Exit(2)
+	if cfg.Tracing.Endpoint != "" {
+		shutdownTracing, err := tracing.Setup(ctx, tracing.Options{
+			Endpoint:    cfg.Tracing.Endpoint,
+			Insecure:    cfg.Tracing.Insecure,
+			SampleRatio: cfg.Tracing.SampleRatio,
+		})
+		if err != nil {
+			return err
+		}
+		defer shutdownTracing(context.Background())
 	}
+
+	elector, err := newElector(cfg.Autoscaler.LeaderElection)
 	if err != nil {
-		panic(err)
+		return err
 	}
-
-	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: os.Getenv("GITHUB_TOKEN")})
-	tc := oauth2.NewClient(ctx, ts)
-	tokenProvider := &githubtoken.RepoProvider{
-		Client: github.NewClient(tc),
-		Org:    *org,
-		Repo:   *repo,
+	if elector != nil {
+		// keep renewing while draining so another replica doesn't take over
+		go elector.Run(ctx)
 	}
 
-	http.Handle("/metrics", promhttp.Handler())
-	go http.ListenAndServe(":9090", nil)
+	githubClient := newGitHubClient(ctx, cfg)
+	tokenProvider := newTokenProvider(githubClient, cfg)
 
-	prepareOpts := interfaces.PrepareOptions{}
-	if *customCloudInitPath != "" {
-		customCloudInitBytes, err := os.ReadFile(*customCloudInitPath)
+	var eventJournal *journal.Journal
+	if cfg.Autoscaler.Journal != "" {
+		eventJournal, err = journal.Open(cfg.Autoscaler.Journal, time.Now)
 		if err != nil {
-			panic(fmt.Errorf("reading %s: %w", *customCloudInitPath, err))
+			return err
+		}
+		defer eventJournal.Close()
+	}
+
+	var demandProvider autoscaler.DemandProvider
+	http.Handle("/metrics", promhttp.Handler())
+	if cfg.GitHub.WebhookSecret != "" {
+		webhookProvider := githubdemand.NewWebhookProvider([]byte(cfg.GitHub.WebhookSecret), prometheus.DefaultRegisterer, eventJournal)
+		http.Handle("/webhook", webhookProvider)
+		demandProvider = webhookProvider
+	}
+	if cfg.GitHub.PollInterval != 0 {
+		pollingProvider := &githubdemand.PollingProvider{
+			Client:   githubClient,
+			Org:      cfg.GitHub.Org,
+			Repo:     cfg.GitHub.Repo,
+			Interval: cfg.GitHub.PollInterval,
 		}
-		prepareOpts.CustomCloudInitOverlay = string(customCloudInitBytes)
+		go pollingProvider.Run(ctx)
+		demandProvider = pollingProvider
 	}
+	go http.ListenAndServe(":9090", nil)
+
+	// the config may be reloaded while it is read by the admin api and the
+	// signal handler
+	var currentConfig atomic.Pointer[config.Config]
+	currentConfig.Store(cfg)
+
+	// back off when the provider or GitHub keeps failing
+	backoff := &autoscaler.Backoff{Min: time.Second * 2, Max: time.Minute * 2}
 
-	autoscaler := autoscaler.New(provider, tokenProvider, autoscaler.AutoscalerConfig{
-		TargetIdle:     *targetIdle,
-		Labels:         *labels,
-		PrepareOptions: prepareOpts,
+	autoscaler := autoscaler.New(tokenProvider, autoscaler.AutoscalerConfig{
+		Pools:          pools,
+		DemandProvider: demandProvider,
+		RunnerRegistry: newRunnerRegistry(githubClient, cfg),
+		Journal:        eventJournal,
 	})
 
-	// only clear resources on SIGINT
-	sigIntChan := make(chan os.Signal, 1)
-	signal.Notify(sigIntChan, syscall.SIGINT, syscall.SIGTERM)
+	if cfg.Admin.Token != "" {
+		http.Handle("/api/v1/", admin.NewHandler(autoscaler, func() (any, error) {
+			return currentConfig.Load().Redacted()
+		}, cfg.Admin.Token))
+	}
+
+	// SIGINT clears idle and starting runners. SIGTERM also waits for active
+	// runners to finish unless we are leaving everything running for a
+	// rolling restart. A second signal aborts the cleanup or drain.
+	sigChan := make(chan os.Signal, 1)
+	stopSignal := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	ctx, cancel := context.WithCancel(ctx)
+	stopCtx, abortStop := context.WithCancel(context.Background())
+	defer abortStop()
 	go func() {
-		sig := <-sigIntChan
-		if sig == syscall.SIGTERM {
+		sig := <-sigChan
+		if sig == syscall.SIGTERM && currentConfig.Load().Autoscaler.SigtermLeaveRunners {
+			releaseLeader(elector)
 			os.Exit(0)
 		}
-		fmt.Printf("Received signal %v, clearing existing resources...\n", sig)
+		slog.Info("received signal, clearing existing resources", "signal", sig.String())
+		stopSignal <- sig
 		cancel()
+		sig = <-sigChan
+		slog.Warn("received second signal, aborting", "signal", sig.String())
+		abortStop()
 	}()
 
-	ticker := time.NewTicker(time.Second * 2)
+	reload := make(chan struct{}, 1)
+	if configPath != "" {
+		go watchConfig(ctx, configPath, reload)
+	}
+
+	timer := time.NewTimer(backoff.Min)
 
+	leading := false
 	for i := 0; ; i++ {
-		// check prepare every 500 iterations (including first)
+		// check prepare every 500 iterations (including first) or when we
+		// become the leader
 		shouldCheckPrepare := i%500 == 0
-		err := autoscaler.Autoscale(ctx, shouldCheckPrepare)
-		if err != nil {
-			if ctx.Err() != nil {
-				if ctx.Err() == nil {
-					fmt.Printf("autoscale failed: %v\n", err)
-				}
+		if elector != nil {
+			wasLeading := leading
+			leading = elector.IsLeader()
+			shouldCheckPrepare = shouldCheckPrepare || (leading && !wasLeading)
+		} else {
+			leading = true
+		}
+		var err error
+		if leading {
+			leaderCtx, cancelLeader := leaderContext(ctx, elector)
+			err = autoscaler.Autoscale(leaderCtx, shouldCheckPrepare)
+			if leaderCtx.Err() != nil && ctx.Err() == nil {
+				slog.Warn("lost leadership while autoscaling", "error", err)
+				err = nil
 			}
+			cancelLeader()
+		}
+		if ctx.Err() != nil {
+			// errors from canceled calls are expected while stopping
+			err = nil
 		}
+		delay := backoff.Next(err)
+		if err != nil {
+			slog.Error("autoscale failed", "failures", backoff.Failures(), "retry_in", delay.Round(time.Millisecond), "error", err)
+		}
+		timer.Reset(delay)
 		select {
-		case <-ticker.C:
+		case <-timer.C:
+		case <-reload:
+			newCfg, err := config.Load(configPath)
+			if err != nil {
+				slog.Error("not reloading config", "error", err)
+				continue
+			}
+			pools, err := poolBuilder.build(newCfg)
+			if err != nil {
+				slog.Error("not reloading config", "error", err)
+				continue
+			}
+			// compare with the last loaded config so that a change is only
+			// reported once
+			fields := newCfg.RequiresRestart(currentConfig.Load())
+			if len(fields) > 0 {
+				slog.Warn("settings changed which are only applied on restart", "settings", fields)
+			}
+			autoscaler.UpdatePools(pools)
+			currentConfig.Store(newCfg)
+			env.logLevel.Set(parseLevel(newCfg.Log.Level))
+			slog.Info("reloaded config", "pools", len(pools))
 		case <-ctx.Done():
-			ctx := context.Background()
+			ctx := stopCtx
+			defer releaseLeader(elector)
+			if elector != nil && !elector.IsLeader() {
+				// runners belong to the leader
+				return nil
+			}
+			drainTimeout := currentConfig.Load().Autoscaler.DrainTimeout
+			if <-stopSignal == syscall.SIGTERM && drainTimeout > 0 {
+				ctx, cancel := context.WithTimeout(ctx, drainTimeout)
+				defer cancel()
+				err := autoscaler.Drain(ctx)
+				if err != nil {
+					slog.Error("drain failed", "error", err)
+				}
+				return nil
+			}
 			err := autoscaler.Cleanup(ctx)
 			if err != nil {
-				fmt.Printf("cleanup failed: %v\n", err)
+				slog.Error("cleanup failed", "error", err)
+			}
+			return nil
+		}
+	}
+}
+
+// watchConfig requests a reload on SIGHUP or when the config file is modified
+func watchConfig(ctx context.Context, path string, reload chan<- struct{}) {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+
+	var lastModTime time.Time
+	stat, err := os.Stat(path)
+	if err == nil {
+		lastModTime = stat.ModTime()
+	}
+
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hupChan:
+		case <-ticker.C:
+			stat, err := os.Stat(path)
+			if err != nil || stat.ModTime().Equal(lastModTime) {
+				continue
 			}
+			lastModTime = stat.ModTime()
+		case <-ctx.Done():
 			return
 		}
+		select {
+		case reload <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// leaderContext returns a context which is canceled when we stop being the
+// leader so that we don't keep creating runners after another replica took
+// over
+func leaderContext(ctx context.Context, elector *leader.Elector) (context.Context, context.CancelFunc) {
+	if elector == nil {
+		return context.WithCancel(ctx)
+	}
+	return elector.Context(ctx)
+}
+
+// newElector creates a leader elector. It returns nil if leader election is
+// disabled.
+func newElector(cfg config.LeaderElection) (*leader.Elector, error) {
+	var lease leader.Lease
+	var err error
+	switch cfg.Type {
+	case "", "none":
+		return nil, nil
+	case "file":
+		lease = &leader.FileLease{Path: cfg.LockFile}
+	case "lxd":
+		lease, err = lxd.NewLease(cfg.LXD.Project)
+	case "gcp":
+		lease, err = gcp.NewLease(cfg.GCSBucket)
+	default:
+		return nil, fmt.Errorf("invalid leader election %s, options are none|file|lxd|gcp", cfg.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create leader lease: %w", err)
+	}
+	identity := cfg.Identity
+	if identity == "" {
+		identity = leader.DefaultIdentity()
+	}
+	leaseDuration := cfg.LeaseDuration
+	if leaseDuration == 0 {
+		leaseDuration = time.Second * 15
+	}
+	return leader.NewElector(lease, identity, leaseDuration, prometheus.DefaultRegisterer), nil
+}
+
+func releaseLeader(elector *leader.Elector) {
+	if elector == nil {
+		return
+	}
+	err := elector.Release(context.Background())
+	if err != nil {
+		slog.Error("release leader failed", "error", err)
 	}
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/autoscaler"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/config"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/gcp"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/lxd"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/tracing"
+)
+
+type cachedProvider struct {
+	settings config.Pool
+	provider interfaces.Provider
+}
+
+// poolBuilder creates autoscaler pools from config. Providers are reused
+// across reloads as long as their settings don't change.
+type poolBuilder struct {
+	providers map[string]cachedProvider
+}
+
+func newPoolBuilder() *poolBuilder {
+	return &poolBuilder{
+		providers: make(map[string]cachedProvider),
+	}
+}
+
+func (b *poolBuilder) build(cfg *config.Config) ([]autoscaler.PoolConfig, error) {
+	var pools []autoscaler.PoolConfig
+	providers := make(map[string]cachedProvider)
+	for _, poolCfg := range cfg.Pools {
+		provider, err := b.provider(poolCfg)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", poolCfg.Name, err)
+		}
+		providers[poolCfg.Name] = cachedProvider{settings: poolCfg, provider: provider}
+
+		prepareOpts, err := readPrepareOptions(poolCfg.CustomCloudInit)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", poolCfg.Name, err)
+		}
+		pools = append(pools, autoscaler.PoolConfig{
+			Name:              poolCfg.Name,
+			Provider:          provider,
+			ProviderName:      poolCfg.Provider,
+			TargetIdle:        poolCfg.TargetIdle,
+			Labels:            strings.Join(poolCfg.Labels, ","),
+			Arch:              poolCfg.Arch,
+			PrepareOptions:    prepareOpts,
+			MaxTotal:          poolCfg.MaxTotal,
+			MaxStarting:       poolCfg.MaxStarting,
+			MaxCreatePerTick:  poolCfg.MaxCreatePerTick,
+			CreateConcurrency: poolCfg.CreateConcurrency,
+			StartingTimeout:   poolCfg.StartingTimeout,
+			MaxActiveDuration: poolCfg.MaxActiveDuration,
+			ScaleDownDelay:    poolCfg.ScaleDownDelay,
+
+			CreateBreakerThreshold: poolCfg.CreateBreakerThreshold,
+			CreateBreakerCooldown:  poolCfg.CreateBreakerCooldown,
+		})
+	}
+	b.providers = providers
+	return pools, nil
+}
+
+func (b *poolBuilder) provider(poolCfg config.Pool) (interfaces.Provider, error) {
+	cached, ok := b.providers[poolCfg.Name]
+	if ok && cached.settings.Provider == poolCfg.Provider && cached.settings.LXD == poolCfg.LXD && cached.settings.GCP == poolCfg.GCP {
+		return cached.provider, nil
+	}
+	var provider interfaces.Provider
+	var err error
+	switch poolCfg.Provider {
+	case "lxd":
+		provider, err = lxd.New(lxd.Options{
+			Pool:    poolCfg.Name,
+			Project: poolCfg.LXD.Project,
+		})
+	case "gcp":
+		provider, err = gcp.New(gcp.Options{
+			Pool:             poolCfg.Name,
+			Project:          poolCfg.GCP.Project,
+			Zone:             poolCfg.GCP.Zone,
+			InstanceTemplate: poolCfg.GCP.InstanceTemplate,
+			Endpoint:         poolCfg.GCP.Endpoint,
+		})
+	default:
+		return nil, fmt.Errorf("invalid provider %s, options are lxd|gcp", poolCfg.Provider)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tracing.WrapProvider(provider, poolCfg.Provider, poolCfg.Name), nil
+}
+
+func readPrepareOptions(customCloudInitPath string) (interfaces.PrepareOptions, error) {
+	prepareOpts := interfaces.PrepareOptions{}
+	if customCloudInitPath != "" {
+		customCloudInitBytes, err := os.ReadFile(customCloudInitPath)
+		if err != nil {
+			return prepareOpts, fmt.Errorf("reading %s: %w", customCloudInitPath, err)
+		}
+		prepareOpts.CustomCloudInitOverlay = string(customCloudInitBytes)
+	}
+	return prepareOpts, nil
+}
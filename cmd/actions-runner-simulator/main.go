@@ -0,0 +1,225 @@
+// actions-runner-simulator replays a job arrival trace against the autoscaler
+// with the fake provider to tune pool settings without creating real
+// instances. Time runs -speedup times faster than real time.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/autoscaler"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/config"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/fake"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+)
+
+// queueDemand reports the queued jobs like the webhook provider would
+type queueDemand struct {
+	queued atomic.Int64
+}
+
+func (d *queueDemand) PendingJobs(ctx context.Context, poolLabels [][]string) ([]int, error) {
+	res := make([]int, len(poolLabels))
+	if len(res) > 0 {
+		// the simulator has a single pool
+		res[0] = int(d.queued.Load())
+	}
+	return res, nil
+}
+
+type result struct {
+	jobs       int
+	unserved   int
+	waits      []time.Duration
+	created    int
+	peak       int
+	idleTime   time.Duration
+	runnerTime time.Duration
+	simulated  time.Duration
+	elapsed    time.Duration
+}
+
+func main() {
+	defaults := config.DefaultPool()
+
+	tracePath := flag.String("trace", "", "CSV file with a job per line as arrival offset and duration (e.g. 90s,12m)")
+	speedup := flag.Float64("speedup", 60, "How many times faster than real time to simulate")
+	interval := flag.Duration("interval", time.Second*2, "Autoscale interval")
+	demand := flag.Bool("demand", true, "Report queued jobs to the autoscaler like webhooks or polling do")
+	timeout := flag.Duration("timeout", time.Hour, "Give up on queued jobs this long after the last job arrives")
+	verbose := flag.Bool("v", false, "Log autoscaler activity")
+	flag.IntVar(&defaults.TargetIdle, "target-idle", defaults.TargetIdle, "Target number of idle runners")
+	flag.IntVar(&defaults.MaxTotal, "max-total", defaults.MaxTotal, "Maximum number of runners (0 is unlimited)")
+	flag.IntVar(&defaults.MaxStarting, "max-starting", defaults.MaxStarting, "Maximum number of runners starting at once (0 is unlimited)")
+	flag.IntVar(&defaults.MaxCreatePerTick, "max-create-per-tick", defaults.MaxCreatePerTick, "Maximum number of runners created per autoscale iteration (0 is unlimited)")
+	flag.IntVar(&defaults.CreateConcurrency, "create-concurrency", defaults.CreateConcurrency, "Number of runners created in parallel")
+	flag.DurationVar(&defaults.StartingTimeout, "starting-timeout", defaults.StartingTimeout, "Delete runners which have not become idle after this long (0 disables)")
+	flag.DurationVar(&defaults.ScaleDownDelay, "scale-down-delay", defaults.ScaleDownDelay, "How long surplus idle runners are kept before they are deleted")
+	flag.IntVar(&defaults.CreateBreakerThreshold, "create-breaker-threshold", defaults.CreateBreakerThreshold, "Stop creating runners after this many consecutive failures (0 disables)")
+	flag.DurationVar(&defaults.CreateBreakerCooldown, "create-breaker-cooldown", defaults.CreateBreakerCooldown, "How long runner creation is stopped before a probe runner is created")
+	var fakeOpts fake.Options
+	flag.DurationVar(&fakeOpts.CreateDelay, "create-delay", time.Second*10, "How long the provider takes to create an instance")
+	flag.DurationVar(&fakeOpts.StartDelay, "start-delay", time.Minute, "How long instances are starting before they are idle")
+	flag.DurationVar(&fakeOpts.DeleteDelay, "delete-delay", time.Second*5, "How long the provider takes to delete an instance")
+	flag.Float64Var(&fakeOpts.CreateFailureRate, "create-failure-rate", 0, "Fraction of instance creations which fail")
+	flag.Float64Var(&fakeOpts.StartFailureRate, "start-failure-rate", 0, "Fraction of instances which never become idle")
+	flag.Int64Var(&fakeOpts.Seed, "seed", 1, "Seed for failure injection")
+	flag.Parse()
+
+	if *tracePath == "" || *speedup <= 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if !*verbose {
+		slog.SetLogLoggerLevel(slog.LevelError)
+	}
+	jobs, err := readTrace(*tracePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// every duration is scaled down to real time
+	scale := func(d time.Duration) time.Duration {
+		return time.Duration(float64(d) / *speedup)
+	}
+	fakeOpts.CreateDelay = scale(fakeOpts.CreateDelay)
+	fakeOpts.StartDelay = scale(fakeOpts.StartDelay)
+	fakeOpts.DeleteDelay = scale(fakeOpts.DeleteDelay)
+	provider := fake.New(fakeOpts)
+
+	var demandProvider *queueDemand
+	cfg := autoscaler.AutoscalerConfig{
+		Pools: []autoscaler.PoolConfig{{
+			Name:              interfaces.DefaultPool,
+			Provider:          provider,
+			ProviderName:      "fake",
+			TargetIdle:        defaults.TargetIdle,
+			MaxTotal:          defaults.MaxTotal,
+			MaxStarting:       defaults.MaxStarting,
+			MaxCreatePerTick:  defaults.MaxCreatePerTick,
+			CreateConcurrency: defaults.CreateConcurrency,
+			StartingTimeout:   scale(defaults.StartingTimeout),
+			ScaleDownDelay:    scale(defaults.ScaleDownDelay),
+
+			CreateBreakerThreshold: defaults.CreateBreakerThreshold,
+			CreateBreakerCooldown:  scale(defaults.CreateBreakerCooldown),
+		}},
+	}
+	if *demand {
+		demandProvider = &queueDemand{}
+		cfg.DemandProvider = demandProvider
+	}
+
+	res := simulate(provider, autoscaler.New(fake.TokenProvider{}, cfg), demandProvider, jobs, scale(*interval), *speedup, *timeout)
+	res.print()
+}
+
+// simulate assigns jobs to idle runners as they arrive while the autoscaler
+// runs every interval. It returns once every job has finished or timeout
+// after the last job arrived.
+func simulate(provider *fake.Provider, a *autoscaler.Autoscaler, demand *queueDemand, jobs []job, interval time.Duration, speedup float64, timeout time.Duration) result {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			err := a.Autoscale(ctx, false)
+			if err != nil && ctx.Err() == nil {
+				slog.Warn("autoscale failed", "error", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	res := result{jobs: len(jobs)}
+	start := time.Now()
+	// simulated time since the start
+	now := func() time.Duration {
+		return time.Duration(float64(time.Since(start)) * speedup)
+	}
+	step := max(time.Duration(float64(time.Second)/speedup), time.Millisecond)
+	ticker := time.NewTicker(step)
+	defer ticker.Stop()
+
+	var queue []job
+	var lastFinish, lastSample time.Duration
+	next := 0
+	deadline := jobs[len(jobs)-1].Arrival + timeout
+	for {
+		simNow := now()
+		for next < len(jobs) && jobs[next].Arrival <= simNow {
+			queue = append(queue, jobs[next])
+			next++
+		}
+		for len(queue) > 0 {
+			_, ok := provider.AssignJob(time.Duration(float64(queue[0].Duration) / speedup))
+			if !ok {
+				break
+			}
+			res.waits = append(res.waits, simNow-queue[0].Arrival)
+			lastFinish = max(lastFinish, simNow+queue[0].Duration)
+			queue = queue[1:]
+		}
+		if demand != nil {
+			demand.queued.Store(int64(len(queue)))
+		}
+
+		metrics, err := provider.RunnerDisposition(ctx)
+		if err == nil {
+			elapsed := simNow - lastSample
+			res.idleTime += elapsed * time.Duration(metrics.IdleCount())
+			res.runnerTime += elapsed * time.Duration(metrics.TotalCount())
+			res.peak = max(res.peak, metrics.TotalCount())
+		}
+		lastSample = simNow
+
+		done := next == len(jobs) && len(queue) == 0 && simNow >= lastFinish
+		if done || simNow >= deadline {
+			res.unserved = len(jobs) - len(res.waits)
+			res.simulated = simNow
+			res.elapsed = time.Since(start)
+			res.created = provider.Created()
+			return res
+		}
+		<-ticker.C
+	}
+}
+
+func (r result) print() {
+	slices.Sort(r.waits)
+	var total time.Duration
+	for _, wait := range r.waits {
+		total += wait
+	}
+	percentile := func(p float64) time.Duration {
+		return r.waits[int(p*float64(len(r.waits)-1))].Round(time.Second)
+	}
+	fmt.Printf("jobs:               %d\n", r.jobs)
+	if r.unserved > 0 {
+		fmt.Printf("jobs never started: %d\n", r.unserved)
+	}
+	if len(r.waits) == 0 {
+		return
+	}
+	fmt.Printf("wait mean:          %s\n", (total / time.Duration(len(r.waits))).Round(time.Second))
+	fmt.Printf("wait p50:           %s\n", percentile(0.5))
+	fmt.Printf("wait p95:           %s\n", percentile(0.95))
+	fmt.Printf("wait max:           %s\n", percentile(1))
+	fmt.Printf("runners created:    %d\n", r.created)
+	fmt.Printf("peak runners:       %d\n", r.peak)
+	fmt.Printf("idle runner min:    %.1f\n", r.idleTime.Minutes())
+	fmt.Printf("total runner min:   %.1f\n", r.runnerTime.Minutes())
+	fmt.Printf("simulated:          %s in %s\n", r.simulated.Round(time.Second), r.elapsed.Round(time.Millisecond))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// job is a job from the trace. Arrival is relative to the start of the
+// simulation.
+type job struct {
+	Arrival  time.Duration
+	Duration time.Duration
+}
+
+// readTrace reads jobs from a CSV file with an arrival offset and a duration
+// per line:
+//
+//	# arrival,duration
+//	0s,5m
+//	90s,12m
+func readTrace(path string) ([]job, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open trace: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	var jobs []job
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read trace: %w", err)
+		}
+		line, _ := r.FieldPos(0)
+		arrival, err := time.ParseDuration(strings.TrimSpace(record[0]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: arrival: %w", path, line, err)
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: duration: %w", path, line, err)
+		}
+		jobs = append(jobs, job{Arrival: arrival, Duration: duration})
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("%s: no jobs", path)
+	}
+	slices.SortStableFunc(jobs, func(a, b job) int {
+		return int(a.Arrival - b.Arrival)
+	})
+	return jobs, nil
+}
@@ -0,0 +1,445 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The longest name generated from a pool name is the prepare instance
+// "actions-runner-ephemeral-<pool>-prepare". Runner names end in a shorter
+// random suffix. Both GCE and LXD limit instance names to 63 characters.
+const (
+	instanceNamePrefix = "actions-runner-ephemeral-"
+	instanceNameSuffix = "-prepare"
+	maxInstanceName    = 63
+	maxPoolNameLength  = maxInstanceName - len(instanceNamePrefix) - len(instanceNameSuffix)
+)
+
+// runnerArchs are the architecture labels GitHub gives runners
+var runnerArchs = []string{"x64", "x86", "arm64", "arm"}
+
+// pool names are used in instance names and GCP labels
+var poolNameRegexp = regexp.MustCompile(fmt.Sprintf(`^[a-z][a-z0-9-]{0,%d}$`, maxPoolNameLength-1))
+
+type Config struct {
+	GitHub     GitHub     `yaml:"github"`
+	Autoscaler Autoscaler `yaml:"autoscaler"`
+	Pools      []Pool     `yaml:"pools"`
+	Log        Log        `yaml:"log"`
+	Tracing    Tracing    `yaml:"tracing"`
+	Admin      Admin      `yaml:"admin"`
+}
+
+// Admin configures the admin API. It is not changed on reload.
+type Admin struct {
+	// Token is required as a bearer token. The API is disabled if empty.
+	Token string `yaml:"token"`
+}
+
+// Tracing exports OpenTelemetry traces. It is not changed on reload.
+type Tracing struct {
+	// Endpoint is the OTLP/HTTP collector. Tracing is disabled if empty.
+	Endpoint string `yaml:"endpoint"`
+	// Insecure disables TLS
+	Insecure bool `yaml:"insecure"`
+	// SampleRatio is the fraction of autoscale iterations which are traced
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+type Log struct {
+	// Level is debug, info, warn, or error. It is applied on reload.
+	Level string `yaml:"level"`
+	// Format is text or json
+	Format string `yaml:"format"`
+}
+
+type GitHub struct {
+	Org  string `yaml:"org"`
+	Repo string `yaml:"repo"`
+	// Token falls back to the GITHUB_TOKEN environment variable
+	Token string `yaml:"token"`
+	// WebhookSecret enables the /webhook demand provider
+	WebhookSecret string `yaml:"webhook_secret"`
+	// PollInterval enables the polling demand provider
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// ReconcileRunners uses the runners registered with GitHub to decide
+	// whether runners are idle or active
+	ReconcileRunners bool `yaml:"reconcile_runners"`
+}
+
+type Autoscaler struct {
+	// DrainTimeout is how long to wait for active runners on SIGTERM
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	// SigtermLeaveRunners exits immediately on SIGTERM
+	SigtermLeaveRunners bool `yaml:"sigterm_leave_runners"`
+	// Journal is a file where runner lifecycle events are appended as JSON
+	// lines, or - for stdout. It is not changed on reload.
+	Journal string `yaml:"journal"`
+	// LeaderElection allows running multiple replicas
+	LeaderElection LeaderElection `yaml:"leader_election"`
+}
+
+// LeaderElection makes sure only one replica manages runners
+type LeaderElection struct {
+	// Type is none, file, lxd, or gcp
+	Type string `yaml:"type"`
+	// LockFile is the path of the lock for the file type
+	LockFile string `yaml:"lock_file"`
+	// LeaseDuration is how long a leader is kept after it stops renewing
+	LeaseDuration time.Duration `yaml:"lease_duration"`
+	// Identity defaults to the hostname and pid
+	Identity string `yaml:"identity"`
+	// LXD selects the project of the lxd type
+	LXD LXD `yaml:"lxd"`
+	// GCSBucket is the bucket of the gcp type
+	GCSBucket string `yaml:"gcs_bucket"`
+}
+
+type Pool struct {
+	Name     string   `yaml:"name"`
+	Provider string   `yaml:"provider"`
+	Labels   []string `yaml:"labels"`
+	// Arch is the architecture label of the runners. It defaults to the
+	// architecture of this host, which is wrong for remote LXD servers and
+	// GCP machine types with another architecture.
+	Arch string `yaml:"arch"`
+	// CustomCloudInit is the path of a cloud-init overlay for the image
+	CustomCloudInit string `yaml:"custom_cloud_init"`
+
+	TargetIdle        int           `yaml:"target_idle"`
+	MaxTotal          int           `yaml:"max_total"`
+	MaxStarting       int           `yaml:"max_starting"`
+	MaxCreatePerTick  int           `yaml:"max_create_per_tick"`
+	CreateConcurrency int           `yaml:"create_concurrency"`
+	StartingTimeout   time.Duration `yaml:"starting_timeout"`
+	MaxActiveDuration time.Duration `yaml:"max_active_duration"`
+	ScaleDownDelay    time.Duration `yaml:"scale_down_delay"`
+	// CreateBreakerThreshold consecutive creation failures stop creation
+	// for CreateBreakerCooldown
+	CreateBreakerThreshold int           `yaml:"create_breaker_threshold"`
+	CreateBreakerCooldown  time.Duration `yaml:"create_breaker_cooldown"`
+
+	LXD LXD `yaml:"lxd"`
+	GCP GCP `yaml:"gcp"`
+}
+
+// LXD settings fall back to the LXD_PROJECT environment variable
+type LXD struct {
+	Project string `yaml:"project"`
+}
+
+// GCP settings fall back to the GOOGLE_CLOUD_PROJECT, GOOGLE_CLOUD_ZONE, and
+// GOOGLE_CLOUD_INSTANCE_TEMPLATE environment variables
+type GCP struct {
+	Project          string `yaml:"project"`
+	Zone             string `yaml:"zone"`
+	InstanceTemplate string `yaml:"instance_template"`
+	// Endpoint overrides the Compute API endpoint
+	Endpoint string `yaml:"endpoint"`
+}
+
+// DefaultPool returns the settings used for anything a pool does not set
+func DefaultPool() Pool {
+	return Pool{
+		Provider:          "lxd",
+		Arch:              hostArch(),
+		TargetIdle:        1,
+		CreateConcurrency: 4,
+		StartingTimeout:   time.Minute * 15,
+		ScaleDownDelay:    time.Minute * 5,
+
+		CreateBreakerThreshold: 5,
+		CreateBreakerCooldown:  time.Minute * 2,
+	}
+}
+
+// hostArch returns the architecture label of runners on this host
+func hostArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x64"
+	case "386":
+		return "x86"
+	default:
+		return runtime.GOARCH
+	}
+}
+
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func Parse(data []byte) (*Config, error) {
+	var root yaml.Node
+	err := yaml.Unmarshal(data, &root)
+	if err != nil {
+		return nil, err
+	}
+	if len(root.Content) == 0 {
+		return nil, errors.New("config is empty")
+	}
+
+	// decode strictly first so that typos are reported
+	cfg := &Config{
+		Tracing: Tracing{SampleRatio: 1},
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// then decode the pools again on top of the defaults
+	poolsNode := lookupNode(root.Content[0], "pools")
+	if poolsNode != nil {
+		for i, poolNode := range poolsNode.Content {
+			pool := DefaultPool()
+			err = poolNode.Decode(&pool)
+			if err != nil {
+				return nil, err
+			}
+			cfg.Pools[i] = pool
+		}
+	}
+
+	err = cfg.validate(root.Content[0])
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// RequiresRestart returns the settings which differ from prev but are only
+// applied on startup
+func (c *Config) RequiresRestart(prev *Config) []string {
+	var fields []string
+	check := func(changed bool, field string) {
+		if changed {
+			fields = append(fields, field)
+		}
+	}
+	check(c.GitHub != prev.GitHub, "github")
+	check(c.Admin != prev.Admin, "admin")
+	check(c.Tracing != prev.Tracing, "tracing")
+	check(c.Log.Format != prev.Log.Format, "log.format")
+	check(c.Autoscaler.Journal != prev.Autoscaler.Journal, "autoscaler.journal")
+	check(c.Autoscaler.LeaderElection != prev.Autoscaler.LeaderElection, "autoscaler.leader_election")
+	return fields
+}
+
+// Redacted returns the config without secrets in the same structure as a
+// config file so that it can be encoded as JSON
+func (c *Config) Redacted() (map[string]any, error) {
+	redacted := *c
+	redactedValue := "REDACTED"
+	if redacted.GitHub.Token != "" {
+		redacted.GitHub.Token = redactedValue
+	}
+	if redacted.GitHub.WebhookSecret != "" {
+		redacted.GitHub.WebhookSecret = redactedValue
+	}
+	if redacted.Admin.Token != "" {
+		redacted.Admin.Token = redactedValue
+	}
+	data, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]any)
+	err = yaml.Unmarshal(data, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// fieldError reports an invalid value along with where it is in the document
+type fieldError struct {
+	path []any
+	msg  string
+	line int
+}
+
+func (e fieldError) Error() string {
+	path := ""
+	for _, elem := range e.path {
+		switch v := elem.(type) {
+		case int:
+			path += fmt.Sprintf("[%d]", v)
+		default:
+			if path != "" {
+				path += "."
+			}
+			path += fmt.Sprint(v)
+		}
+	}
+	if e.line == 0 {
+		return fmt.Sprintf("%s: %s", path, e.msg)
+	}
+	return fmt.Sprintf("line %d: %s: %s", e.line, path, e.msg)
+}
+
+// Validate checks a config which was not parsed from YAML
+func (c *Config) Validate() error {
+	return c.validate(nil)
+}
+
+// validate checks the config. root is used to report line numbers if set.
+func (c *Config) validate(root *yaml.Node) error {
+	var errs []error
+	fail := func(msg string, path ...any) {
+		errs = append(errs, fieldError{
+			path: path,
+			msg:  msg,
+			line: lineOf(root, path...),
+		})
+	}
+
+	if c.GitHub.Org == "" {
+		fail("must be set", "github", "org")
+	}
+	if c.GitHub.Repo == "" {
+		fail("must be set", "github", "repo")
+	}
+	if c.GitHub.WebhookSecret != "" && c.GitHub.PollInterval != 0 {
+		fail("cannot be used with webhook_secret", "github", "poll_interval")
+	}
+	if c.GitHub.PollInterval < 0 {
+		fail("must not be negative", "github", "poll_interval")
+	}
+	switch c.Autoscaler.LeaderElection.Type {
+	case "", "none", "lxd":
+	case "gcp":
+		if c.Autoscaler.LeaderElection.GCSBucket == "" {
+			fail("must be set when type is gcp", "autoscaler", "leader_election", "gcs_bucket")
+		}
+	case "file":
+		if c.Autoscaler.LeaderElection.LockFile == "" {
+			fail("must be set when type is file", "autoscaler", "leader_election", "lock_file")
+		}
+	default:
+		fail("must be none, file, lxd, or gcp", "autoscaler", "leader_election", "type")
+	}
+	if c.Autoscaler.LeaderElection.LeaseDuration < 0 {
+		fail("must not be negative", "autoscaler", "leader_election", "lease_duration")
+	}
+	switch c.Log.Level {
+	case "", "debug", "info", "warn", "error":
+	default:
+		fail("must be debug, info, warn, or error", "log", "level")
+	}
+	switch c.Log.Format {
+	case "", "text", "json":
+	default:
+		fail("must be text or json", "log", "format")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		fail("must be between 0 and 1", "tracing", "sample_ratio")
+	}
+	if len(c.Pools) == 0 {
+		fail("at least one pool must be configured", "pools")
+	}
+
+	names := make(map[string]bool)
+	for i, pool := range c.Pools {
+		if !poolNameRegexp.MatchString(pool.Name) {
+			fail(fmt.Sprintf("must match %s", poolNameRegexp), "pools", i, "name")
+		} else if names[pool.Name] {
+			fail("duplicate pool name", "pools", i, "name")
+		}
+		names[pool.Name] = true
+		if pool.Provider != "lxd" && pool.Provider != "gcp" {
+			fail("must be lxd or gcp", "pools", i, "provider")
+		}
+		if len(pool.Labels) == 0 {
+			fail("must not be empty", "pools", i, "labels")
+		}
+		if !slices.Contains(runnerArchs, pool.Arch) {
+			fail("must be x64, x86, arm64, or arm", "pools", i, "arch")
+		}
+		nonNegative := []struct {
+			key string
+			val int64
+		}{
+			{"target_idle", int64(pool.TargetIdle)},
+			{"max_total", int64(pool.MaxTotal)},
+			{"max_starting", int64(pool.MaxStarting)},
+			{"max_create_per_tick", int64(pool.MaxCreatePerTick)},
+			{"create_concurrency", int64(pool.CreateConcurrency)},
+			{"starting_timeout", int64(pool.StartingTimeout)},
+			{"max_active_duration", int64(pool.MaxActiveDuration)},
+			{"scale_down_delay", int64(pool.ScaleDownDelay)},
+			{"create_breaker_threshold", int64(pool.CreateBreakerThreshold)},
+			{"create_breaker_cooldown", int64(pool.CreateBreakerCooldown)},
+		}
+		for _, field := range nonNegative {
+			if field.val < 0 {
+				fail("must not be negative", "pools", i, field.key)
+			}
+		}
+		if pool.MaxTotal > 0 && pool.TargetIdle > pool.MaxTotal {
+			fail("must not be greater than max_total", "pools", i, "target_idle")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// lookupNode finds the value node at path where strings are mapping keys and
+// ints are sequence indexes
+func lookupNode(node *yaml.Node, path ...any) *yaml.Node {
+	for _, elem := range path {
+		if node == nil {
+			return nil
+		}
+		switch v := elem.(type) {
+		case string:
+			if node.Kind != yaml.MappingNode {
+				return nil
+			}
+			var next *yaml.Node
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == v {
+					next = node.Content[i+1]
+					break
+				}
+			}
+			node = next
+		case int:
+			if node.Kind != yaml.SequenceNode || v >= len(node.Content) {
+				return nil
+			}
+			node = node.Content[v]
+		default:
+			panic(fmt.Sprintf("invalid path element %v", v))
+		}
+	}
+	return node
+}
+
+// lineOf returns the line of the deepest node which exists along path
+func lineOf(root *yaml.Node, path ...any) int {
+	for i := len(path); i >= 0; i-- {
+		node := lookupNode(root, path[:i]...)
+		if node != nil {
+			return node.Line
+		}
+	}
+	return 0
+}
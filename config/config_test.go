@@ -0,0 +1,201 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/stretchr/testify.v1/require"
+)
+
+const validConfig = `github:
+  org: org
+  repo: repo
+  token: ghp_secret
+pools:
+  - name: build
+    provider: lxd
+    labels: [build]
+    target_idle: 2
+`
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]byte(validConfig))
+	require.NoError(t, err)
+	require.Len(t, cfg.Pools, 1)
+	pool := cfg.Pools[0]
+	require.Equal(t, 2, pool.TargetIdle)
+	// unset settings use the defaults
+	defaults := DefaultPool()
+	require.Equal(t, defaults.StartingTimeout, pool.StartingTimeout)
+	require.Equal(t, defaults.CreateBreakerThreshold, pool.CreateBreakerThreshold)
+	require.Equal(t, 1.0, cfg.Tracing.SampleRatio)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr []string
+	}{
+		{
+			name:    "empty",
+			config:  "",
+			wantErr: []string{"config is empty"},
+		},
+		{
+			name:    "unknown field",
+			config:  validConfig + "unknown: true\n",
+			wantErr: []string{"field unknown not found"},
+		},
+		{
+			name: "missing fields",
+			config: `github:
+  org: org
+`,
+			wantErr: []string{
+				"line 2: github.repo: must be set",
+				"line 1: pools: at least one pool must be configured",
+			},
+		},
+		{
+			name: "invalid pools",
+			config: `github:
+  org: org
+  repo: repo
+pools:
+  - name: build
+    provider: lxd
+    labels: [build]
+    target_idle: 3
+    max_total: 2
+  - name: build
+    provider: aws
+    labels: []
+    arch: sparc
+    scale_down_delay: -1m
+`,
+			wantErr: []string{
+				"line 8: pools[0].target_idle: must not be greater than max_total",
+				"line 10: pools[1].name: duplicate pool name",
+				"line 11: pools[1].provider: must be lxd or gcp",
+				"line 12: pools[1].labels: must not be empty",
+				"line 13: pools[1].arch: must be x64, x86, arm64, or arm",
+				"line 14: pools[1].scale_down_delay: must not be negative",
+			},
+		},
+		{
+			name: "invalid settings",
+			config: validConfig + `autoscaler:
+  leader_election:
+    type: gcp
+log:
+  level: verbose
+tracing:
+  sample_ratio: 2
+`,
+			wantErr: []string{
+				"line 12: autoscaler.leader_election.gcs_bucket: must be set when type is gcp",
+				"line 14: log.level: must be debug, info, warn, or error",
+				"line 16: tracing.sample_ratio: must be between 0 and 1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.config))
+			require.Error(t, err)
+			for _, want := range tt.wantErr {
+				require.Contains(t, err.Error(), want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := &Config{GitHub: GitHub{Org: "org", Repo: "repo"}, Pools: []Pool{DefaultPool()}}
+	cfg.Pools[0].Name = "Invalid Name"
+	cfg.Pools[0].Labels = []string{"build"}
+	err := cfg.Validate()
+	require.Error(t, err)
+	// there are no line numbers without a document
+	require.Equal(t, "pools[0].name: must match "+poolNameRegexp.String(), err.Error())
+}
+
+func TestPoolNameLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "a"},
+		{name: strings.Repeat("a", 30)},
+		{name: strings.Repeat("a", 31), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d characters", len(tt.name)), func(t *testing.T) {
+			cfg := &Config{GitHub: GitHub{Org: "org", Repo: "repo"}, Pools: []Pool{DefaultPool()}}
+			cfg.Pools[0].Name = tt.name
+			cfg.Pools[0].Labels = []string{"build"}
+			err := cfg.Validate()
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, len("actions-runner-ephemeral-"+tt.name+"-prepare") <= 63)
+		})
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg, err := Parse([]byte(validConfig))
+	require.NoError(t, err)
+	redacted, err := cfg.Redacted()
+	require.NoError(t, err)
+	github := redacted["github"].(map[string]any)
+	require.Equal(t, "REDACTED", github["token"])
+	require.Equal(t, "org", github["org"])
+	require.Equal(t, "ghp_secret", cfg.GitHub.Token)
+}
+
+func TestRequiresRestart(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string
+	}{
+		{
+			name:   "unchanged",
+			change: func(c *Config) {},
+		},
+		{
+			name: "hot reloadable",
+			change: func(c *Config) {
+				c.Log.Level = "debug"
+				c.Autoscaler.DrainTimeout = time.Minute
+				c.Pools = append(c.Pools, DefaultPool())
+			},
+		},
+		{
+			name: "restart required",
+			change: func(c *Config) {
+				c.GitHub.Repo = "other"
+				c.Admin.Token = "secret"
+				c.Tracing.SampleRatio = 0.5
+				c.Log.Format = "json"
+				c.Autoscaler.Journal = "-"
+				c.Autoscaler.LeaderElection.Type = "file"
+			},
+			want: []string{"github", "admin", "tracing", "log.format", "autoscaler.journal", "autoscaler.leader_election"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev := &Config{GitHub: GitHub{Org: "org", Repo: "repo"}}
+			next := *prev
+			tt.change(&next)
+			require.Equal(t, tt.want, next.RequiresRestart(prev))
+		})
+	}
+}
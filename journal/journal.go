@@ -0,0 +1,117 @@
+// Package journal records runner lifecycle events as JSON lines
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	// RunnerRequested is recorded before a runner is created with the reason
+	// it is needed
+	RunnerRequested    EventType = "requested"
+	RunnerCreated      EventType = "created"
+	RunnerCreateFailed EventType = "create_failed"
+	// RunnerStarting, RunnerIdle, and RunnerActive are recorded when a runner
+	// is first seen in that state
+	RunnerStarting EventType = "starting"
+	RunnerIdle     EventType = "idle"
+	RunnerActive   EventType = "active"
+	// RunnerFinished is recorded when an active runner is gone because it
+	// finished its job
+	RunnerFinished EventType = "finished"
+	// RunnerReaped is recorded before a stuck runner is deleted
+	RunnerReaped  EventType = "reaped"
+	RunnerDeleted EventType = "deleted"
+
+	PrepareStarted  EventType = "prepare_started"
+	PrepareFinished EventType = "prepare_finished"
+	PrepareFailed   EventType = "prepare_failed"
+
+	// JobQueued, JobStarted, and JobCompleted are recorded for workflow_job
+	// webhook deliveries. Started and completed jobs have the instance of the
+	// runner which took them.
+	JobQueued    EventType = "job_queued"
+	JobStarted   EventType = "job_started"
+	JobCompleted EventType = "job_completed"
+)
+
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     EventType `json:"type"`
+	Pool     string    `json:"pool,omitempty"`
+	Instance string    `json:"instance,omitempty"`
+	// RequestID correlates the events of a single runner creation
+	RequestID string `json:"request_id,omitempty"`
+	// JobID is the ID of the workflow job of job events
+	JobID  int64  `json:"job_id,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// DurationSeconds is how long the operation took. For started jobs it is
+	// how long the job was queued and for completed jobs how long it ran.
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+}
+
+// Journal appends events to a writer. A nil Journal discards events.
+type Journal struct {
+	now func() time.Time
+
+	mu  sync.Mutex
+	enc *json.Encoder
+	w   io.Writer
+}
+
+// New creates a journal which stamps events with now. It should be the clock
+// used to measure durations so that times and durations agree.
+func New(w io.Writer, now func() time.Time) *Journal {
+	return &Journal{
+		now: now,
+		enc: json.NewEncoder(w),
+		w:   w,
+	}
+}
+
+// Open opens a journal appending to path or stdout if path is -
+func Open(path string, now func() time.Time) (*Journal, error) {
+	if path == "-" {
+		return New(os.Stdout, now), nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open journal: %w", err)
+	}
+	return New(file, now), nil
+}
+
+// Record writes an event. Time is set to now if it is not set. Write errors
+// are returned but callers usually ignore them since the journal is
+// informational.
+func (j *Journal) Record(event Event) error {
+	if j == nil {
+		return nil
+	}
+	if event.Time.IsZero() {
+		event.Time = j.now()
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.enc.Encode(event)
+}
+
+// Close closes the underlying writer if it is a file other than stdout
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	closer, ok := j.w.(io.Closer)
+	if !ok || j.w == os.Stdout {
+		return nil
+	}
+	return closer.Close()
+}
@@ -0,0 +1,68 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/stretchr/testify.v1/require"
+)
+
+func decode(t *testing.T, data []byte) []Event {
+	var events []Event
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var event Event
+		require.NoError(t, dec.Decode(&event))
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestRecord(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	explicit := now.Add(-time.Minute)
+	tests := []struct {
+		name  string
+		event Event
+		want  Event
+	}{
+		{name: "stamped with clock", event: Event{Type: RunnerIdle, Pool: "default"}, want: Event{Time: now, Type: RunnerIdle, Pool: "default"}},
+		{name: "explicit time", event: Event{Time: explicit, Type: RunnerIdle}, want: Event{Time: explicit, Type: RunnerIdle}},
+		{name: "job", event: Event{Type: JobStarted, JobID: 1, DurationSeconds: 30}, want: Event{Time: now, Type: JobStarted, JobID: 1, DurationSeconds: 30}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			j := New(&buf, func() time.Time { return now })
+			require.NoError(t, j.Record(tt.event))
+			require.Equal(t, []Event{tt.want}, decode(t, buf.Bytes()))
+		})
+	}
+}
+
+func TestRecordNil(t *testing.T) {
+	var j *Journal
+	require.NoError(t, j.Record(Event{Type: RunnerIdle}))
+	require.NoError(t, j.Close())
+}
+
+func TestOpenAppends(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	for _, instance := range []string{"a", "b"} {
+		j, err := Open(path, func() time.Time { return now })
+		require.NoError(t, err)
+		require.NoError(t, j.Record(Event{Type: RunnerCreated, Instance: instance}))
+		require.NoError(t, j.Close())
+	}
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, []Event{
+		{Time: now, Type: RunnerCreated, Instance: "a"},
+		{Time: now, Type: RunnerCreated, Instance: "b"},
+	}, decode(t, data))
+}
@@ -0,0 +1,59 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileLease elects a leader between processes on the same host with an
+// advisory lock. The lock is released by the kernel if the process dies, so
+// ttl is not used.
+type FileLease struct {
+	Path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (l *FileLease) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		return true, nil
+	}
+	file, err := os.OpenFile(l.Path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return false, fmt.Errorf("open lock file: %w", err)
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		file.Close()
+		return false, nil
+	}
+	if err != nil {
+		file.Close()
+		return false, fmt.Errorf("lock file: %w", err)
+	}
+	// record the holder for debugging
+	_ = file.Truncate(0)
+	_, _ = file.WriteAt([]byte(holder+"\n"), 0)
+	l.file = file
+	return true, nil
+}
+
+func (l *FileLease) Release(ctx context.Context, holder string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	// closing the file releases the lock
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
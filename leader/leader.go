@@ -0,0 +1,216 @@
+// Package leader elects a single autoscaler replica to manage runners
+package leader
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Lease is a lock shared between replicas which expires if it is not renewed
+type Lease interface {
+	// Acquire takes the lease for holder or renews it if holder already has it.
+	// It returns false if another holder has an unexpired lease.
+	Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error)
+	// Release gives up the lease if holder has it
+	Release(ctx context.Context, holder string) error
+}
+
+// Record is the value stored by leases which don't have native expiry
+type Record struct {
+	Holder  string
+	Expires time.Time
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf("%s %d", r.Holder, r.Expires.Unix())
+}
+
+// Available checks if holder may take the lease
+func (r Record) Available(holder string, now time.Time) bool {
+	return r.Holder == "" || r.Holder == holder || now.After(r.Expires)
+}
+
+// ParseRecord parses a record written by Record.String. An empty value is an
+// empty record.
+func ParseRecord(value string) (Record, error) {
+	if value == "" {
+		return Record{}, nil
+	}
+	holder, expires, ok := strings.Cut(value, " ")
+	if !ok {
+		return Record{}, fmt.Errorf("invalid lease record %q", value)
+	}
+	expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return Record{}, fmt.Errorf("invalid lease expiry %q: %w", expires, err)
+	}
+	return Record{Holder: holder, Expires: time.Unix(expiresUnix, 0)}, nil
+}
+
+// DefaultIdentity is unique per process
+func DefaultIdentity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// Elector renews a lease in the background and reports whether we hold it
+type Elector struct {
+	lease    Lease
+	identity string
+	ttl      time.Duration
+	// now is replaced by tests
+	now         func() time.Time
+	leaderGauge prometheus.Gauge
+
+	mu          sync.Mutex
+	leaderUntil time.Time
+	// term is closed when leadership is lost
+	term chan struct{}
+}
+
+// NewElector creates an elector. Leadership is lost at most ttl after the
+// leader stops renewing, so ttl is also the maximum failover time. The leader
+// gauge is registered with reg.
+func NewElector(lease Lease, identity string, ttl time.Duration, reg prometheus.Registerer) *Elector {
+	leaderGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "actions_runner_autoscaler",
+		Name:      "leader",
+		Help:      "1 if this replica is the leader and manages runners",
+	})
+	reg.MustRegister(leaderGauge)
+	return &Elector{
+		lease:       lease,
+		identity:    identity,
+		ttl:         ttl,
+		now:         time.Now,
+		leaderGauge: leaderGauge,
+	}
+}
+
+// IsLeader checks if we held the lease at the last renewal. Leadership is
+// given up as soon as a renewal fails so that we stop before another replica
+// can take over.
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.now().Before(e.leaderUntil)
+}
+
+// Context returns a context which is canceled when leadership is lost or
+// parent is done. It is already canceled if we aren't the leader.
+func (e *Elector) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	e.mu.Lock()
+	term, until := e.term, e.leaderUntil
+	e.mu.Unlock()
+	if term == nil {
+		cancel()
+		return ctx, cancel
+	}
+	go func() {
+		defer cancel()
+		// leadership also ends if a renewal takes too long
+		timer := time.NewTimer(until.Sub(e.now()))
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-term:
+				return
+			case <-timer.C:
+				e.mu.Lock()
+				until = e.leaderUntil
+				e.mu.Unlock()
+				remaining := until.Sub(e.now())
+				if remaining <= 0 {
+					return
+				}
+				timer.Reset(remaining)
+			}
+		}
+	}()
+	return ctx, cancel
+}
+
+// Run renews the lease until ctx is done then releases it
+func (e *Elector) Run(ctx context.Context) {
+	// renew often enough that a slow renewal doesn't lose the lease
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		e.renew(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (e *Elector) renew(ctx context.Context) {
+	wasLeader := e.IsLeader()
+	start := e.now()
+	acquired, err := e.lease.Acquire(ctx, e.identity, e.ttl)
+	if err != nil {
+		slog.Warn("error when renewing leader lease", "identity", e.identity, "error", err)
+	}
+
+	e.mu.Lock()
+	if acquired {
+		// the lease may have been written at any point during the request
+		e.leaderUntil = start.Add(e.ttl * 2 / 3)
+	} else {
+		// we may still hold the lease after an error but can't be sure
+		e.leaderUntil = time.Time{}
+	}
+	isLeader := e.now().Before(e.leaderUntil)
+	if isLeader && e.term == nil {
+		e.term = make(chan struct{})
+	} else if !isLeader {
+		e.endTerm()
+	}
+	e.mu.Unlock()
+
+	if isLeader {
+		e.leaderGauge.Set(1)
+	} else {
+		e.leaderGauge.Set(0)
+	}
+	if isLeader != wasLeader {
+		slog.Info("leadership changed", "identity", e.identity, "leader", isLeader)
+	}
+}
+
+// Release gives up leadership immediately so another replica can take over
+func (e *Elector) Release(ctx context.Context) error {
+	e.mu.Lock()
+	e.leaderUntil = time.Time{}
+	e.endTerm()
+	e.mu.Unlock()
+	e.leaderGauge.Set(0)
+	err := e.lease.Release(ctx, e.identity)
+	if err != nil {
+		return fmt.Errorf("release lease: %w", err)
+	}
+	return nil
+}
+
+// endTerm cancels the contexts of the current leadership. e.mu must be held.
+func (e *Elector) endTerm() {
+	if e.term != nil {
+		close(e.term)
+		e.term = nil
+	}
+}
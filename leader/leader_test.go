@@ -0,0 +1,191 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/stretchr/testify.v1/require"
+)
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// memoryLease stores a record like the LXD and GCP leases do
+type memoryLease struct {
+	now    func() time.Time
+	mu     sync.Mutex
+	record Record
+	err    error
+}
+
+func (l *memoryLease) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return false, l.err
+	}
+	if !l.record.Available(holder, l.now()) {
+		return false, nil
+	}
+	l.record = Record{Holder: holder, Expires: l.now().Add(ttl)}
+	return true, nil
+}
+
+func (l *memoryLease) Release(ctx context.Context, holder string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.record.Holder == holder {
+		l.record = Record{}
+	}
+	return nil
+}
+
+func newTestElector(lease Lease, clock *testClock, identity string) *Elector {
+	e := NewElector(lease, identity, time.Second*15, prometheus.NewRegistry())
+	e.now = clock.Now
+	return e
+}
+
+func requireCanceled(t *testing.T, ctx context.Context) {
+	t.Helper()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context was not canceled")
+	}
+}
+
+func TestElectorTakeover(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	lease := &memoryLease{now: clock.Now}
+	a := newTestElector(lease, clock, "a")
+	b := newTestElector(lease, clock, "b")
+
+	a.renew(ctx)
+	b.renew(ctx)
+	require.True(t, a.IsLeader())
+	require.False(t, b.IsLeader())
+	leaderCtx, cancel := a.Context(ctx)
+	defer cancel()
+
+	// a stops renewing and gives up before its lease expires
+	clock.Advance(time.Second * 10)
+	require.False(t, a.IsLeader())
+	b.renew(ctx)
+	require.False(t, b.IsLeader())
+
+	// b takes over once the ttl has passed
+	clock.Advance(time.Second * 6)
+	b.renew(ctx)
+	require.True(t, b.IsLeader())
+	a.renew(ctx)
+	require.False(t, a.IsLeader())
+	requireCanceled(t, leaderCtx)
+}
+
+func TestElectorRenewalError(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	lease := &memoryLease{now: clock.Now}
+	e := newTestElector(lease, clock, "a")
+
+	e.renew(ctx)
+	require.True(t, e.IsLeader())
+	leaderCtx, cancel := e.Context(ctx)
+	defer cancel()
+
+	// we can't know whether we still hold the lease
+	lease.err = errors.New("connection refused")
+	e.renew(ctx)
+	require.False(t, e.IsLeader())
+	requireCanceled(t, leaderCtx)
+
+	// we still hold the lease so nobody else took over
+	lease.err = nil
+	e.renew(ctx)
+	require.True(t, e.IsLeader())
+	leaderCtx, cancel = e.Context(ctx)
+	defer cancel()
+	require.NoError(t, leaderCtx.Err())
+}
+
+func TestElectorRelease(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	lease := &memoryLease{now: clock.Now}
+	a := newTestElector(lease, clock, "a")
+	b := newTestElector(lease, clock, "b")
+
+	// not being the leader cancels right away
+	leaderCtx, cancel := a.Context(ctx)
+	defer cancel()
+	requireCanceled(t, leaderCtx)
+
+	a.renew(ctx)
+	leaderCtx, cancel = a.Context(ctx)
+	defer cancel()
+	require.NoError(t, a.Release(ctx))
+	require.False(t, a.IsLeader())
+	requireCanceled(t, leaderCtx)
+
+	// another replica takes over without waiting for the ttl
+	b.renew(ctx)
+	require.True(t, b.IsLeader())
+}
+
+func TestParseRecord(t *testing.T) {
+	record := Record{Holder: "host-123", Expires: time.Unix(1735689600, 0)}
+	parsed, err := ParseRecord(record.String())
+	require.NoError(t, err)
+	require.Equal(t, record.Holder, parsed.Holder)
+	require.True(t, record.Expires.Equal(parsed.Expires))
+
+	parsed, err = ParseRecord("")
+	require.NoError(t, err)
+	require.True(t, parsed.Available("anyone", time.Now()))
+
+	for _, value := range []string{"host-123", "host-123 soon"} {
+		_, err = ParseRecord(value)
+		require.Error(t, err, value)
+	}
+}
+
+func TestFileLease(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "leader.lock")
+	a := &FileLease{Path: path}
+	b := &FileLease{Path: path}
+
+	acquired, err := a.Acquire(ctx, "a", time.Second)
+	require.NoError(t, err)
+	require.True(t, acquired)
+	acquired, err = b.Acquire(ctx, "b", time.Second)
+	require.NoError(t, err)
+	require.False(t, acquired)
+
+	require.NoError(t, a.Release(ctx, "a"))
+	acquired, err = b.Acquire(ctx, "b", time.Second)
+	require.NoError(t, err)
+	require.True(t, acquired)
+	require.NoError(t, b.Release(ctx, "b"))
+}
@@ -0,0 +1,377 @@
+// Package fake is an in-memory provider for simulations and tests. Instances
+// are starting for StartDelay, then idle until a job is assigned with
+// AssignJob, then active until the job finishes and they are gone.
+package fake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+)
+
+var (
+	ErrCreateFailed = errors.New("injected create failure")
+	ErrNotFound     = interfaces.ErrRunnerNotFound
+)
+
+type Options struct {
+	// CreateDelay is how long CreateRunner blocks
+	CreateDelay time.Duration
+	// StartDelay is how long instances are starting before they are idle
+	StartDelay time.Duration
+	// DeleteDelay is how long deletions block when waiting
+	DeleteDelay time.Duration
+	// PrepareDelay is how long PrepareImage blocks
+	PrepareDelay time.Duration
+
+	// CreateFailureRate is the fraction of CreateRunner calls which fail
+	CreateFailureRate float64
+	// StartFailureRate is the fraction of instances which never become idle
+	StartFailureRate float64
+	// Seed makes failure injection repeatable
+	Seed int64
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+type instance struct {
+	id        string
+	labels    []string
+	createdAt time.Time
+	// idleAt is zero if the instance never becomes idle
+	idleAt   time.Time
+	activeAt time.Time
+	// goneAt is when the job finishes and the instance removes itself
+	goneAt time.Time
+}
+
+// state returns the state at now and when it last changed
+func (i *instance) state(now time.Time) (interfaces.RunnerState, time.Time) {
+	switch {
+	case !i.goneAt.IsZero() && !now.Before(i.goneAt):
+		return interfaces.RunnerStateStopped, i.goneAt
+	case !i.activeAt.IsZero():
+		return interfaces.RunnerStateActive, i.activeAt
+	case !i.idleAt.IsZero() && !now.Before(i.idleAt):
+		return interfaces.RunnerStateIdle, i.idleAt
+	}
+	return interfaces.RunnerStateStarting, time.Time{}
+}
+
+type Provider struct {
+	opts Options
+
+	mu        sync.Mutex
+	rand      *rand.Rand
+	instances []*instance
+	created   int
+	images    []interfaces.Image
+	err       error
+}
+
+// New creates a provider without an image
+func New(opts Options) *Provider {
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &Provider{
+		opts: opts,
+		rand: rand.New(rand.NewSource(opts.Seed)),
+	}
+}
+
+// InjectError makes every call fail with err until it is called with nil
+func (p *Provider) InjectError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+// Created returns how many instances have been created
+func (p *Provider) Created() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.created
+}
+
+// SetState moves an instance to state like the runner hooks would. Active
+// instances stay active until they are deleted.
+func (p *Provider) SetState(id string, state interfaces.RunnerState) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.opts.Now()
+	p.prune(now)
+	for _, instance := range p.instances {
+		if instance.id != id {
+			continue
+		}
+		instance.idleAt, instance.activeAt, instance.goneAt = time.Time{}, time.Time{}, time.Time{}
+		switch state {
+		case interfaces.RunnerStateIdle:
+			instance.idleAt = now
+		case interfaces.RunnerStateActive:
+			instance.idleAt, instance.activeAt = now, now
+		case interfaces.RunnerStateStopped:
+			instance.goneAt = now
+		}
+		return nil
+	}
+	return fmt.Errorf("set state of %s: %w", id, ErrNotFound)
+}
+
+// AssignJob makes the oldest idle instance active for duration. It returns
+// false if no instance is idle.
+func (p *Provider) AssignJob(duration time.Duration) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.opts.Now()
+	p.prune(now)
+	for _, instance := range p.instances {
+		state, _ := instance.state(now)
+		if state != interfaces.RunnerStateIdle {
+			continue
+		}
+		instance.activeAt = now
+		instance.goneAt = now.Add(duration)
+		return instance.id, true
+	}
+	return "", false
+}
+
+// prune removes instances which finished their job. The caller must hold mu.
+func (p *Provider) prune(now time.Time) {
+	p.instances = slices.DeleteFunc(p.instances, func(i *instance) bool {
+		state, _ := i.state(now)
+		return state == interfaces.RunnerStateStopped
+	})
+}
+
+// check returns the context or injected error and prunes finished instances
+func (p *Provider) check(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prune(p.opts.Now())
+	return p.err
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Provider) ImageCreatedAt(ctx context.Context) (time.Time, error) {
+	err := p.check(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.images) == 0 {
+		return time.Time{}, nil
+	}
+	return p.images[len(p.images)-1].CreatedAt, nil
+}
+
+func (p *Provider) PrepareImage(ctx context.Context, opts interfaces.PrepareOptions) error {
+	err := p.check(ctx)
+	if err != nil {
+		return err
+	}
+	err = sleep(ctx, p.opts.PrepareDelay)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.images {
+		p.images[i].Current = false
+	}
+	p.images = append(p.images, interfaces.Image{
+		ID:        fmt.Sprintf("fake-image-%d", len(p.images)),
+		CreatedAt: p.opts.Now(),
+		Current:   true,
+	})
+	return nil
+}
+
+func (p *Provider) ListImages(ctx context.Context) ([]interfaces.Image, error) {
+	err := p.check(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.images), nil
+}
+
+func (p *Provider) CreateRunner(ctx context.Context, url, token, labels string) (string, error) {
+	err := p.check(ctx)
+	if err != nil {
+		return "", err
+	}
+	err = sleep(ctx, p.opts.CreateDelay)
+	if err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rand.Float64() < p.opts.CreateFailureRate {
+		return "", ErrCreateFailed
+	}
+	p.created++
+	now := p.opts.Now()
+	instance := &instance{
+		id:        fmt.Sprintf("fake-%d", p.created),
+		labels:    strings.Split(labels, ","),
+		createdAt: now,
+	}
+	if p.rand.Float64() >= p.opts.StartFailureRate {
+		instance.idleAt = now.Add(p.opts.StartDelay)
+	}
+	p.instances = append(p.instances, instance)
+	return instance.id, nil
+}
+
+func (p *Provider) DeleteRunners(ctx context.Context, count int, wait bool) ([]string, error) {
+	err := p.check(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	p.mu.Lock()
+	now := p.opts.Now()
+	for _, instance := range p.instances {
+		if len(ids) >= count {
+			break
+		}
+		state, _ := instance.state(now)
+		if state == interfaces.RunnerStateActive {
+			continue
+		}
+		ids = append(ids, instance.id)
+	}
+	p.remove(ids)
+	p.mu.Unlock()
+	if wait {
+		err = sleep(ctx, p.opts.DeleteDelay)
+	}
+	return ids, err
+}
+
+func (p *Provider) DeleteRunnersByID(ctx context.Context, ids []string, mode interfaces.DeleteMode, wait bool) ([]string, error) {
+	err := p.check(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	now := p.opts.Now()
+	var deleted []string
+	for _, id := range ids {
+		i := slices.IndexFunc(p.instances, func(i *instance) bool { return i.id == id })
+		if i < 0 {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("delete %s: %w", id, ErrNotFound)
+		}
+		state, _ := p.instances[i].state(now)
+		if mode == interfaces.DeleteForce || state != interfaces.RunnerStateActive {
+			deleted = append(deleted, id)
+		}
+	}
+	p.remove(deleted)
+	p.mu.Unlock()
+	if wait {
+		err = sleep(ctx, p.opts.DeleteDelay)
+	}
+	return deleted, err
+}
+
+// remove removes instances by ID. The caller must hold mu.
+func (p *Provider) remove(ids []string) {
+	p.instances = slices.DeleteFunc(p.instances, func(i *instance) bool {
+		return slices.Contains(ids, i.id)
+	})
+}
+
+type disposition struct {
+	startingCount int
+	idleCount     int
+	activeCount   int
+}
+
+func (d disposition) TotalCount() int {
+	return d.activeCount + d.idleCount + d.startingCount
+}
+func (d disposition) StartingCount() int {
+	return d.startingCount
+}
+func (d disposition) IdleCount() int {
+	return d.idleCount
+}
+func (d disposition) ActiveCount() int {
+	return d.activeCount
+}
+
+func (p *Provider) RunnerDisposition(ctx context.Context) (interfaces.RunnerDispositionMetrics, error) {
+	err := p.check(ctx)
+	if err != nil {
+		return disposition{}, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := disposition{}
+	now := p.opts.Now()
+	for _, instance := range p.instances {
+		state, _ := instance.state(now)
+		switch state {
+		case interfaces.RunnerStateActive:
+			res.activeCount++
+		case interfaces.RunnerStateIdle:
+			res.idleCount++
+		default:
+			res.startingCount++
+		}
+	}
+	return res, nil
+}
+
+func (p *Provider) ListRunners(ctx context.Context) ([]interfaces.Runner, error) {
+	err := p.check(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.opts.Now()
+	runners := make([]interfaces.Runner, 0, len(p.instances))
+	for _, instance := range p.instances {
+		state, changedAt := instance.state(now)
+		runners = append(runners, interfaces.Runner{
+			ID:              instance.id,
+			State:           state,
+			CreatedAt:       instance.createdAt,
+			LastStateChange: changedAt,
+			Labels:          instance.labels,
+		})
+	}
+	return runners, nil
+}
@@ -0,0 +1,26 @@
+package fake
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/providertest"
+	"gopkg.in/stretchr/testify.v1/require"
+)
+
+func TestProvider(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) providertest.Harness {
+		p := New(Options{StartDelay: time.Hour})
+		return providertest.Harness{
+			Provider: p,
+			AddImage: func(t *testing.T) {
+				require.NoError(t, p.PrepareImage(context.Background(), interfaces.PrepareOptions{}))
+			},
+			SetState: func(t *testing.T, id string, state interfaces.RunnerState) {
+				require.NoError(t, p.SetState(id, state))
+			},
+		}
+	})
+}
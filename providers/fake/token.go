@@ -0,0 +1,18 @@
+package fake
+
+import "context"
+
+// TokenProvider hands out registration tokens without calling GitHub
+type TokenProvider struct{}
+
+func (TokenProvider) URL() string {
+	return "https://github.com/fake/fake"
+}
+
+func (TokenProvider) Token(ctx context.Context) (string, error) {
+	return "fake-token", nil
+}
+
+func (TokenProvider) RemoveRunner(ctx context.Context, name string) error {
+	return nil
+}
@@ -0,0 +1,387 @@
+package gcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// fakeCompute is an in-process stand-in for the parts of the Compute API used
+// by the provider. Operations apply their effect when they are done.
+type fakeCompute struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	instances  map[string]*compute.Instance
+	images     map[string]*compute.Image
+	templates  map[string]*compute.InstanceTemplate
+	operations map[string]*fakeOperation
+	created    int
+	// sourceTemplates are the instance templates of instances by name
+	sourceTemplates map[string]string
+
+	// pollsUntilDone is how many times an operation is polled before it is
+	// done. Operations are done when they are returned if it is zero.
+	pollsUntilDone int
+	// pageSize limits the number of items per list page (0 is unlimited)
+	pageSize int
+	// failures are the errors of the next operation of each type
+	failures map[string]*compute.OperationErrorErrors
+}
+
+type fakeOperation struct {
+	op    *compute.Operation
+	polls int
+	// apply makes the change once the operation is done
+	apply func()
+}
+
+func newFakeCompute(t *testing.T) *fakeCompute {
+	f := &fakeCompute{
+		instances:  make(map[string]*compute.Instance),
+		images:     make(map[string]*compute.Image),
+		templates:  make(map[string]*compute.InstanceTemplate),
+		operations: make(map[string]*fakeOperation),
+		failures:   make(map[string]*compute.OperationErrorErrors),
+
+		sourceTemplates: make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /compute/v1/projects/{project}/zones/{zone}/instances", f.listInstances)
+	mux.HandleFunc("POST /compute/v1/projects/{project}/zones/{zone}/instances", f.insertInstance)
+	mux.HandleFunc("GET /compute/v1/projects/{project}/zones/{zone}/instances/{name}", f.getInstance)
+	mux.HandleFunc("DELETE /compute/v1/projects/{project}/zones/{zone}/instances/{name}", f.deleteInstance)
+	mux.HandleFunc("GET /compute/v1/projects/{project}/global/images", f.listImages)
+	mux.HandleFunc("POST /compute/v1/projects/{project}/global/images", f.insertImage)
+	mux.HandleFunc("DELETE /compute/v1/projects/{project}/global/images/{name}", f.deleteImage)
+	mux.HandleFunc("GET /compute/v1/projects/{project}/global/instanceTemplates/{name}", f.getTemplate)
+	mux.HandleFunc("GET /compute/v1/projects/{project}/zones/{zone}/operations/{name}", f.getOperation)
+	mux.HandleFunc("GET /compute/v1/projects/{project}/global/operations/{name}", f.getOperation)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// Endpoint is the base path of the API
+func (f *fakeCompute) Endpoint() string {
+	return f.URL + "/compute/v1/"
+}
+
+func (f *fakeCompute) addImage(name string, labels map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.images[name] = &compute.Image{
+		Name:              name,
+		Labels:            labels,
+		CreationTimestamp: time.Now().Format(time.RFC3339),
+	}
+}
+
+func (f *fakeCompute) addInstance(name, status string, labels map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.instances[name] = &compute.Instance{
+		Name:              name,
+		Status:            status,
+		Labels:            labels,
+		CreationTimestamp: time.Now().Format(time.RFC3339),
+	}
+}
+
+func (f *fakeCompute) addTemplate(template *compute.InstanceTemplate) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.templates[template.Name] = template
+}
+
+// failNext makes the next operation of operationType fail
+func (f *fakeCompute) failNext(operationType, code, message string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[operationType] = &compute.OperationErrorErrors{Code: code, Message: message}
+}
+
+// setLabel sets an instance label like the runner hooks do with gcloud
+func (f *fakeCompute) setLabel(name, key, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	instance := f.instances[name]
+	if instance == nil {
+		return fmt.Errorf("instance %s not found", name)
+	}
+	instance.Labels[key] = value
+	return nil
+}
+
+func (f *fakeCompute) instance(name string) *compute.Instance {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.instances[name]
+}
+
+func (f *fakeCompute) sourceTemplate(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sourceTemplates[name]
+}
+
+func (f *fakeCompute) imageNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.images {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, format string, args ...any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": googleapi.Error{Code: code, Message: fmt.Sprintf(format, args...)},
+	})
+}
+
+// matchesFilter supports labels.key=value filters
+func matchesFilter(labels map[string]string, filter string) bool {
+	if filter == "" {
+		return true
+	}
+	key, value, _ := strings.Cut(filter, "=")
+	key, ok := strings.CutPrefix(key, "labels.")
+	return ok && labels[key] == value
+}
+
+// page returns the page of names selected by the pageToken and maxResults
+// parameters and the token of the next page. The caller must hold mu.
+func (f *fakeCompute) page(r *http.Request, names []string) ([]string, string) {
+	slices.Sort(names)
+	start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	size := f.pageSize
+	if maxResults, _ := strconv.Atoi(r.URL.Query().Get("maxResults")); maxResults > 0 && (size == 0 || maxResults < size) {
+		size = maxResults
+	}
+	if size == 0 || start+size >= len(names) {
+		return names[min(start, len(names)):], ""
+	}
+	return names[start : start+size], strconv.Itoa(start + size)
+}
+
+// operation creates an operation which runs apply once it is done. The caller
+// must hold mu.
+func (f *fakeCompute) operation(r *http.Request, operationType, target string, apply func()) *compute.Operation {
+	f.created++
+	op := &compute.Operation{
+		Name:          fmt.Sprintf("operation-%d", f.created),
+		OperationType: operationType,
+		TargetLink:    target,
+		Status:        "RUNNING",
+		Zone:          r.PathValue("zone"),
+	}
+	f.operations[op.Name] = &fakeOperation{op: op, apply: apply}
+	f.poll(op.Name)
+	res := *op
+	return &res
+}
+
+// poll advances an operation. The caller must hold mu.
+func (f *fakeCompute) poll(name string) {
+	fakeOp := f.operations[name]
+	if fakeOp.op.Status == "DONE" {
+		return
+	}
+	if fakeOp.polls < f.pollsUntilDone {
+		fakeOp.polls++
+		return
+	}
+	fakeOp.op.Status = "DONE"
+	if failure := f.failures[fakeOp.op.OperationType]; failure != nil {
+		delete(f.failures, fakeOp.op.OperationType)
+		fakeOp.op.Error = &compute.OperationError{Errors: []*compute.OperationErrorErrors{failure}}
+		return
+	}
+	fakeOp.apply()
+}
+
+func (f *fakeCompute) getOperation(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := r.PathValue("name")
+	if f.operations[name] == nil {
+		writeError(w, http.StatusNotFound, "operation %s not found", name)
+		return
+	}
+	f.poll(name)
+	writeJSON(w, f.operations[name].op)
+}
+
+func (f *fakeCompute) listInstances(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name, instance := range f.instances {
+		if matchesFilter(instance.Labels, r.URL.Query().Get("filter")) {
+			names = append(names, name)
+		}
+	}
+	names, next := f.page(r, names)
+	list := &compute.InstanceList{NextPageToken: next}
+	for _, name := range names {
+		list.Items = append(list.Items, f.instances[name])
+	}
+	writeJSON(w, list)
+}
+
+func (f *fakeCompute) insertInstance(w http.ResponseWriter, r *http.Request) {
+	var instance compute.Instance
+	err := json.NewDecoder(r.Body).Decode(&instance)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "decode instance: %v", err)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.instances[instance.Name] != nil {
+		writeError(w, http.StatusConflict, "instance %s already exists", instance.Name)
+		return
+	}
+	if source := r.URL.Query().Get("sourceInstanceTemplate"); source != "" {
+		template := f.templates[path.Base(source)]
+		if template == nil {
+			writeError(w, http.StatusNotFound, "instance template %s not found", source)
+			return
+		}
+		f.sourceTemplates[instance.Name] = source
+		if instance.MachineType == "" {
+			instance.MachineType = template.Properties.MachineType
+		}
+		if instance.Disks == nil {
+			instance.Disks = template.Properties.Disks
+		}
+	}
+	if instance.Labels == nil {
+		instance.Labels = make(map[string]string)
+	}
+	instance.Status = "PROVISIONING"
+	instance.CreationTimestamp = time.Now().Format(time.RFC3339)
+	f.instances[instance.Name] = &instance
+	writeJSON(w, f.operation(r, "insert", instance.Name, func() {
+		instance.Status = "RUNNING"
+		// prepare instances shut down once cloud-init is done
+		if instance.Labels["status"] == labelStatusPreparing {
+			instance.Status = "TERMINATED"
+		}
+	}))
+}
+
+func (f *fakeCompute) getInstance(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	instance := f.instances[r.PathValue("name")]
+	if instance == nil {
+		writeError(w, http.StatusNotFound, "instance %s not found", r.PathValue("name"))
+		return
+	}
+	writeJSON(w, instance)
+}
+
+func (f *fakeCompute) deleteInstance(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := r.PathValue("name")
+	if f.instances[name] == nil {
+		writeError(w, http.StatusNotFound, "instance %s not found", name)
+		return
+	}
+	f.instances[name].Status = "STOPPING"
+	writeJSON(w, f.operation(r, "delete", name, func() {
+		delete(f.instances, name)
+	}))
+}
+
+func (f *fakeCompute) listImages(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name, image := range f.images {
+		if matchesFilter(image.Labels, r.URL.Query().Get("filter")) {
+			names = append(names, name)
+		}
+	}
+	names, next := f.page(r, names)
+	list := &compute.ImageList{NextPageToken: next}
+	for _, name := range names {
+		list.Items = append(list.Items, f.images[name])
+	}
+	writeJSON(w, list)
+}
+
+func (f *fakeCompute) insertImage(w http.ResponseWriter, r *http.Request) {
+	var image compute.Image
+	err := json.NewDecoder(r.Body).Decode(&image)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "decode image: %v", err)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.images[image.Name] != nil {
+		writeError(w, http.StatusConflict, "image %s already exists", image.Name)
+		return
+	}
+	disk := f.instances[path.Base(image.SourceDisk)]
+	if disk == nil {
+		writeError(w, http.StatusBadRequest, "source disk %s not found", image.SourceDisk)
+		return
+	}
+	if disk.Status != "TERMINATED" {
+		writeError(w, http.StatusBadRequest, "source disk %s is in use by a %s instance", image.SourceDisk, disk.Status)
+		return
+	}
+	writeJSON(w, f.operation(r, "insert", image.Name, func() {
+		image.CreationTimestamp = time.Now().Format(time.RFC3339)
+		f.images[image.Name] = &image
+	}))
+}
+
+func (f *fakeCompute) deleteImage(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := r.PathValue("name")
+	if f.images[name] == nil {
+		writeError(w, http.StatusNotFound, "image %s not found", name)
+		return
+	}
+	writeJSON(w, f.operation(r, "delete", name, func() {
+		delete(f.images, name)
+	}))
+}
+
+func (f *fakeCompute) getTemplate(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	template := f.templates[r.PathValue("name")]
+	if template == nil {
+		writeError(w, http.StatusNotFound, "instance template %s not found", r.PathValue("name"))
+		return
+	}
+	writeJSON(w, template)
+}
@@ -2,9 +2,12 @@ package gcp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,27 +15,63 @@ import (
 
 	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/common"
 	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
 
 	"github.com/samber/lo"
 )
 
 const labelStatusPreparing = "preparing"
 const labelStatusStarting = "starting"
+const runnerLabelsMetadataKey = "runner-labels"
 
 // must be lowercase because of gcp api requirements
 const typeLabelValue = "actions-runner-ephemeral"
 
 var typeLabelFilter = fmt.Sprintf("labels.type=%s", typeLabelValue)
 
+var tracer = otel.Tracer("github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/gcp")
+
 //go:embed cloud-init-prepare.yml
 var cloudInitPrepareOverlay string
 
+type Options struct {
+	// Pool scopes the instances and images managed by the provider so that
+	// multiple pools can share a project. It must be a valid label value.
+	Pool string
+
+	// Project, Zone, and InstanceTemplate default to GOOGLE_CLOUD_PROJECT,
+	// GOOGLE_CLOUD_ZONE, and GOOGLE_CLOUD_INSTANCE_TEMPLATE
+	Project          string
+	Zone             string
+	InstanceTemplate string
+
+	// Endpoint overrides the Compute API endpoint, e.g. for a private
+	// endpoint or a local fake
+	Endpoint string
+	// ClientOptions are passed to the Compute API client
+	ClientOptions []option.ClientOption
+	// PollInterval is how often operations are checked. It defaults to 5s.
+	PollInterval time.Duration
+}
+
 type Provider struct {
 	client    *compute.Service
 	projectID string
 	zone      string
 	template  string
+	pool      string
+	// namePrefix is the prefix of instance and image names
+	namePrefix string
+	// pollInterval is how often operations and the prepare instance are
+	// checked
+	pollInterval time.Duration
+	// cloudInitPrepare renders the cloud-init used to prepare images
+	cloudInitPrepare func(ctx context.Context, opts interfaces.PrepareOptions) (string, error)
 }
 
 func getRegionFromZone(zone string) string {
@@ -40,7 +79,10 @@ func getRegionFromZone(zone string) string {
 	return strings.Join(parts[:len(parts)-1], "-")
 }
 
-func mustGetEnv(key string) (string, error) {
+func valueOrEnv(value, key string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
 	res, ok := os.LookupEnv(key)
 	if !ok {
 		return "", fmt.Errorf("%s must be set", key)
@@ -48,45 +90,111 @@ func mustGetEnv(key string) (string, error) {
 	return res, nil
 }
 
-func New() (*Provider, error) {
+func New(opts Options) (*Provider, error) {
 	ctx := context.Background()
-	client, err := compute.NewService(ctx)
+	clientOpts := opts.ClientOptions
+	if opts.Endpoint != "" {
+		clientOpts = append(clientOpts, option.WithEndpoint(opts.Endpoint))
+	}
+	client, err := compute.NewService(ctx, clientOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("create compute client: %w", err)
 	}
 
-	project, err := mustGetEnv("GOOGLE_CLOUD_PROJECT")
+	project, err := valueOrEnv(opts.Project, "GOOGLE_CLOUD_PROJECT")
 	if err != nil {
 		return nil, err
 	}
 
-	zone, err := mustGetEnv("GOOGLE_CLOUD_ZONE")
+	zone, err := valueOrEnv(opts.Zone, "GOOGLE_CLOUD_ZONE")
 	if err != nil {
 		return nil, err
 	}
 
-	template := os.Getenv("GOOGLE_CLOUD_INSTANCE_TEMPLATE")
+	template := opts.InstanceTemplate
+	if template == "" {
+		template = os.Getenv("GOOGLE_CLOUD_INSTANCE_TEMPLATE")
+	}
+
+	if opts.Pool == "" {
+		opts.Pool = interfaces.DefaultPool
+	}
+	namePrefix := typeLabelValue
+	if opts.Pool != interfaces.DefaultPool {
+		namePrefix = fmt.Sprintf("%s-%s", typeLabelValue, opts.Pool)
+	}
+	if opts.PollInterval == 0 {
+		opts.PollInterval = time.Second * 5
+	}
 
 	return &Provider{
-		client:    client,
-		projectID: project,
-		zone:      zone,
-		template:  template,
+		client:       client,
+		projectID:    project,
+		zone:         zone,
+		template:     template,
+		pool:         opts.Pool,
+		namePrefix:   namePrefix,
+		pollInterval: opts.PollInterval,
+
+		cloudInitPrepare: CloudInitPrepare,
 	}, nil
 }
 
+// inPool checks the pool label. Resources created before pools existed belong
+// to the default pool.
+func (p *Provider) inPool(labels map[string]string) bool {
+	pool := labels["pool"]
+	if pool == "" {
+		pool = interfaces.DefaultPool
+	}
+	return pool == p.pool
+}
+
+// listInstances returns the instances in our pool
+func (p *Provider) listInstances(ctx context.Context) ([]*compute.Instance, error) {
+	var instances []*compute.Instance
+	err := p.client.Instances.List(p.projectID, p.zone).Filter(typeLabelFilter).Pages(ctx, func(list *compute.InstanceList) error {
+		for _, instance := range list.Items {
+			if p.inPool(instance.Labels) {
+				instances = append(instances, instance)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return instances, nil
+}
+
+// listImages returns the images in our pool
+func (p *Provider) listImages(ctx context.Context) ([]*compute.Image, error) {
+	var images []*compute.Image
+	err := p.client.Images.List(p.projectID).Filter(typeLabelFilter).Pages(ctx, func(list *compute.ImageList) error {
+		for _, image := range list.Items {
+			if p.inPool(image.Labels) {
+				images = append(images, image)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
 func (p *Provider) getLatestImage(ctx context.Context) (*compute.Image, error) {
-	resp, err := p.client.Images.List(p.projectID).Filter(typeLabelFilter).Context(ctx).Do()
+	images, err := p.listImages(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("list images: %w", err)
 	}
 
-	if len(resp.Items) == 0 {
+	if len(images) == 0 {
 		return nil, nil
 	}
 
 	// Sort images by creation timestamp in descending order
-	images := resp.Items
 	sort.Slice(images, func(i, j int) bool {
 		return images[i].CreationTimestamp > images[j].CreationTimestamp
 	})
@@ -105,9 +213,40 @@ func (p *Provider) ImageCreatedAt(ctx context.Context) (time.Time, error) {
 	return time.Parse(time.RFC3339, image.CreationTimestamp)
 }
 
+// CloudInitPrepare renders the cloud-init used to prepare images
+func CloudInitPrepare(ctx context.Context, opts interfaces.PrepareOptions) (string, error) {
+	return common.GetCloudInitPrepare(ctx, cloudInitPrepareOverlay, opts.CustomCloudInitOverlay)
+}
+
+// ListImages returns the images in our pool. The newest one is current.
+func (p *Provider) ListImages(ctx context.Context) ([]interfaces.Image, error) {
+	images, err := p.listImages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list images: %w", err)
+	}
+	var res []interfaces.Image
+	for _, image := range images {
+		createdAt, err := time.Parse(time.RFC3339, image.CreationTimestamp)
+		if err != nil {
+			return nil, fmt.Errorf("parse creation timestamp of %s: %w", image.Name, err)
+		}
+		res = append(res, interfaces.Image{
+			ID:        image.Name,
+			CreatedAt: createdAt,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.After(res[j].CreatedAt)
+	})
+	if len(res) > 0 {
+		res[0].Current = true
+	}
+	return res, nil
+}
+
 func (p *Provider) PrepareImage(ctx context.Context, opts interfaces.PrepareOptions) error {
-	instanceName := fmt.Sprintf("%s-prepare", typeLabelValue)
-	cloudInitPrepare, err := common.GetCloudInitPrepare(ctx, cloudInitPrepareOverlay, opts.CustomCloudInitOverlay)
+	instanceName := fmt.Sprintf("%s-prepare", p.namePrefix)
+	cloudInitPrepare, err := p.cloudInitPrepare(ctx, opts)
 	if err != nil {
 		return fmt.Errorf("get cloud init prepare: %w", err)
 	}
@@ -116,6 +255,7 @@ func (p *Provider) PrepareImage(ctx context.Context, opts interfaces.PrepareOpti
 		Name: instanceName,
 		Labels: map[string]string{
 			"type":   typeLabelValue,
+			"pool":   p.pool,
 			"status": labelStatusPreparing,
 		},
 		Metadata: &compute.Metadata{
@@ -193,15 +333,19 @@ func (p *Provider) PrepareImage(ctx context.Context, opts interfaces.PrepareOpti
 			break
 		}
 
-		time.Sleep(5 * time.Second)
+		err = sleep(ctx, p.pollInterval)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Create new image
-	newImageName := fmt.Sprintf("%s-%s", typeLabelValue, lo.RandomString(5, lo.LowerCaseLettersCharset))
+	newImageName := fmt.Sprintf("%s-%s", p.namePrefix, lo.RandomString(5, lo.LowerCaseLettersCharset))
 	imageOp, err := p.client.Images.Insert(p.projectID, &compute.Image{
 		Name: newImageName,
 		Labels: map[string]string{
 			"type": typeLabelValue,
+			"pool": p.pool,
 		},
 		SourceDisk: fmt.Sprintf("projects/%s/zones/%s/disks/%s",
 			p.projectID, p.zone, instanceName),
@@ -221,12 +365,12 @@ func (p *Provider) PrepareImage(ctx context.Context, opts interfaces.PrepareOpti
 	}
 
 	// Delete old images
-	images, err := p.client.Images.List(p.projectID).Filter(typeLabelFilter).Context(ctx).Do()
+	images, err := p.listImages(ctx)
 	if err != nil {
 		return fmt.Errorf("list old images: %w", err)
 	}
 
-	for _, image := range images.Items {
+	for _, image := range images {
 		if image.Name != newImageName {
 			_, err := p.client.Images.Delete(p.projectID, image.Name).Context(ctx).Do()
 			if err != nil {
@@ -244,22 +388,23 @@ func (p *Provider) PrepareImage(ctx context.Context, opts interfaces.PrepareOpti
 	return nil
 }
 
-func (p *Provider) CreateRunner(ctx context.Context, url, token, labels string) error {
-	instanceName := fmt.Sprintf("actions-runner-ephemeral-%s", lo.RandomString(5, lo.LowerCaseLettersCharset))
+func (p *Provider) CreateRunner(ctx context.Context, url, token, labels string) (string, error) {
+	instanceName := fmt.Sprintf("%s-%s", p.namePrefix, lo.RandomString(5, lo.LowerCaseLettersCharset))
 	cloudInitConf := common.GetCloudInitStart(url, token, labels)
 
 	latestImage, err := p.getLatestImage(ctx)
 	if err != nil {
-		return fmt.Errorf("get latest image: %w", err)
+		return "", fmt.Errorf("get latest image: %w", err)
 	}
 	if latestImage == nil {
-		return fmt.Errorf("no runner image found")
+		return "", fmt.Errorf("no runner image found")
 	}
 
 	instance := &compute.Instance{
 		Name: instanceName,
 		Labels: map[string]string{
 			"type":   typeLabelValue,
+			"pool":   p.pool,
 			"status": labelStatusStarting,
 		},
 		Metadata: &compute.Metadata{
@@ -268,6 +413,10 @@ func (p *Provider) CreateRunner(ctx context.Context, url, token, labels string)
 					Key:   "user-data",
 					Value: &cloudInitConf,
 				},
+				{
+					Key:   runnerLabelsMetadataKey,
+					Value: &labels,
+				},
 			},
 		},
 	}
@@ -311,7 +460,7 @@ func (p *Provider) CreateRunner(ctx context.Context, url, token, labels string)
 	} else {
 		template, err := p.client.InstanceTemplates.Get(p.projectID, p.template).Context(ctx).Do()
 		if err != nil {
-			return fmt.Errorf("get instance template: %w", err)
+			return "", fmt.Errorf("get instance template: %w", err)
 		}
 
 		// Copy the template disks but override the boot disk's source image.
@@ -326,50 +475,55 @@ func (p *Provider) CreateRunner(ctx context.Context, url, token, labels string)
 		opBuilder = opBuilder.SourceInstanceTemplate(p.template)
 	}
 
-	op, err := opBuilder.Do()
+	insertCtx, span := tracer.Start(ctx, "gcp.insertInstance", trace.WithAttributes(attribute.String("instance", instanceName)))
+	op, err := opBuilder.Context(insertCtx).Do()
+	tracing.End(span, err)
 	if err != nil {
-		return fmt.Errorf("create instance: %w", err)
+		return "", fmt.Errorf("create instance: %w", err)
 	}
 
 	err = p.waitOperation(ctx, op)
 	if err != nil {
-		return fmt.Errorf("wait for instance creation: %w", err)
+		return "", fmt.Errorf("wait for instance creation: %w", err)
 	}
 
-	return nil
+	return instanceName, nil
 }
 
-// DeleteRunners deletes N runner instances
-func (p *Provider) DeleteRunners(ctx context.Context, count int, wait bool) error {
-	listRes, err := p.client.Instances.List(p.projectID, p.zone).Filter(typeLabelFilter).Context(ctx).Do()
+// DeleteRunners deletes N idle or starting runner instances
+func (p *Provider) DeleteRunners(ctx context.Context, count int, wait bool) ([]string, error) {
+	poolInstances, err := p.listInstances(ctx)
 	if err != nil {
-		return fmt.Errorf("listing instances: %w", err)
+		return nil, fmt.Errorf("listing instances: %w", err)
 	}
 
+	// never interrupt a running job or the image preparation. Stopped
+	// instances are already going away.
 	var instances []*compute.Instance
-	for _, instance := range listRes.Items {
-		if instance.Labels["status"] != "active" {
-			instances = append(instances, instance)
+	for _, instance := range poolInstances {
+		switch instance.Status {
+		case "STOPPING", "STOPPED", "TERMINATED":
+			continue
 		}
+		switch instance.Labels["status"] {
+		case "active", labelStatusPreparing:
+			continue
+		}
+		instances = append(instances, instance)
 	}
 
 	// Create a slice to store operations
 	var operations []*compute.Operation
+	var names []string
 
 	// Delete up to count instances
 	for i := 0; i < count && i < len(instances); i++ {
 		op, err := p.client.Instances.Delete(p.projectID, p.zone, instances[i].Name).Context(ctx).Do()
 		if err != nil {
-			return fmt.Errorf("deleting instance %s: %w", instances[i].Name, err)
-		}
-
-		if wait {
-			err = p.waitOperation(ctx, op)
-			if err != nil {
-				return fmt.Errorf("waiting for instance deletion %s: %w", instances[i].Name, err)
-			}
+			return names, fmt.Errorf("deleting instance %s: %w", instances[i].Name, err)
 		}
 		operations = append(operations, op)
+		names = append(names, instances[i].Name)
 	}
 
 	// Wait for all operations to complete if wait is true
@@ -377,39 +531,119 @@ func (p *Provider) DeleteRunners(ctx context.Context, count int, wait bool) erro
 		for _, op := range operations {
 			err := p.waitOperation(ctx, op)
 			if err != nil {
-				return fmt.Errorf("waiting for instance deletion: %w", err)
+				return names, fmt.Errorf("waiting for instance deletion: %w", err)
 			}
 		}
 	}
 
-	return nil
+	return names, nil
 }
 
-func (p *Provider) waitOperation(ctx context.Context, op *compute.Operation) error {
-	for {
-		// sleep first since operations may 404 after creation
-		time.Sleep(5 * time.Second)
+// DeleteRunnersByID deletes runner instances. Unless mode is DeleteForce,
+// instances which are active or already stopping are skipped. If wait is true,
+// it waits for the deletions to complete.
+func (p *Provider) DeleteRunnersByID(ctx context.Context, ids []string, mode interfaces.DeleteMode, wait bool) ([]string, error) {
+	instances, err := p.listInstances(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing instances: %w", err)
+	}
+	// never delete VMs which aren't our runners
+	for _, id := range ids {
+		if !slices.ContainsFunc(instances, func(instance *compute.Instance) bool {
+			return instance.Name == id && instance.Labels["status"] != labelStatusPreparing
+		}) {
+			return nil, fmt.Errorf("deleting instance %s: %w", id, interfaces.ErrRunnerNotFound)
+		}
+	}
+
+	var errs []error
+	operations := make([]*compute.Operation, 0, len(ids))
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		// the status labels were just listed so they are as fresh as we can get
+		if mode != interfaces.DeleteForce && !canDelete(instances, id) {
+			continue
+		}
+		op, err := p.client.Instances.Delete(p.projectID, p.zone, id).Context(ctx).Do()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("deleting instance %s: %w", id, err))
+			continue
+		}
+		operations = append(operations, op)
+		names = append(names, id)
+	}
+	if !wait {
+		return names, errors.Join(errs...)
+	}
+
+	deleted := make([]string, 0, len(names))
+	for i, op := range operations {
+		err := p.waitOperation(ctx, op)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("waiting for instance deletion %s: %w", names[i], err))
+			continue
+		}
+		deleted = append(deleted, names[i])
+	}
+	return deleted, errors.Join(errs...)
+}
+
+// canDelete checks that an instance isn't running a job
+func canDelete(instances []*compute.Instance, id string) bool {
+	i := slices.IndexFunc(instances, func(instance *compute.Instance) bool { return instance.Name == id })
+	switch instances[i].Status {
+	case "STOPPING", "STOPPED", "TERMINATED":
+		return false
+	}
+	return instances[i].Labels["status"] != "active"
+}
 
-		var result *compute.Operation
-		var err error
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
+func (p *Provider) waitOperation(ctx context.Context, op *compute.Operation) (err error) {
+	ctx, span := tracer.Start(ctx, "gcp.waitOperation", trace.WithAttributes(
+		attribute.String("operation", op.Name),
+		attribute.String("operation_type", op.OperationType),
+		attribute.String("target", op.TargetLink),
+	))
+	defer func() { tracing.End(span, err) }()
+	for op.Status != "DONE" {
+		// sleep first since operations may 404 right after creation
+		err := sleep(ctx, p.pollInterval)
+		if err != nil {
+			return err
+		}
 		if op.Zone != "" {
-			result, err = p.client.ZoneOperations.Get(p.projectID, p.zone, op.Name).Context(ctx).Do()
+			op, err = p.client.ZoneOperations.Get(p.projectID, p.zone, op.Name).Context(ctx).Do()
 		} else {
-			result, err = p.client.GlobalOperations.Get(p.projectID, op.Name).Context(ctx).Do()
+			op, err = p.client.GlobalOperations.Get(p.projectID, op.Name).Context(ctx).Do()
 		}
-
 		if err != nil {
 			return fmt.Errorf("get operation: %w", err)
 		}
+	}
+	return operationError(op)
+}
 
-		if result.Status == "DONE" {
-			if result.Error != nil {
-				return fmt.Errorf("operation failed: %v", result.Error)
-			}
-			return nil
-		}
+// operationError returns the errors of a finished operation
+func operationError(op *compute.Operation) error {
+	if op.Error == nil || len(op.Error.Errors) == 0 {
+		return nil
+	}
+	var messages []string
+	for _, opErr := range op.Error.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", opErr.Code, opErr.Message))
 	}
+	return fmt.Errorf("operation %s failed: %s", op.Name, strings.Join(messages, "; "))
 }
 
 type disposition struct {
@@ -437,12 +671,12 @@ func (d disposition) PreparingCount() int {
 }
 
 func (p *Provider) RunnerDisposition(ctx context.Context) (interfaces.RunnerDispositionMetrics, error) {
-	listRes, err := p.client.Instances.List(p.projectID, p.zone).Filter(typeLabelFilter).Context(ctx).Do()
+	instances, err := p.listInstances(ctx)
 	if err != nil {
 		return disposition{}, fmt.Errorf("getting instances: %w", err)
 	}
 	res := disposition{}
-	for _, instance := range listRes.Items {
+	for _, instance := range instances {
 		switch instance.Status {
 		case "STOPPING", "STOPPED", "TERMINATED":
 			res.stoppedCount++
@@ -457,10 +691,61 @@ func (p *Provider) RunnerDisposition(ctx context.Context) (interfaces.RunnerDisp
 			res.idleCount++
 		case labelStatusPreparing:
 			res.preparingCount++
-		case labelStatusStarting:
+		default:
+			// instances which haven't set a status yet are starting like in
+			// ListRunners
 			res.startingCount++
 		}
 	}
 
 	return res, nil
 }
+
+func (p *Provider) ListRunners(ctx context.Context) ([]interfaces.Runner, error) {
+	instances, err := p.listInstances(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting instances: %w", err)
+	}
+	var runners []interfaces.Runner
+	for _, instance := range instances {
+		labelStatus := instance.Labels["status"]
+		if labelStatus == labelStatusPreparing {
+			continue
+		}
+		createdAt, err := time.Parse(time.RFC3339, instance.CreationTimestamp)
+		if err != nil {
+			return nil, fmt.Errorf("parsing creation timestamp of %s: %w", instance.Name, err)
+		}
+		runner := interfaces.Runner{
+			ID:        instance.Name,
+			State:     interfaces.RunnerStateStarting,
+			CreatedAt: createdAt,
+			Metadata: map[string]string{
+				"status":      instance.Status,
+				"zone":        p.zone,
+				"machineType": instance.MachineType,
+			},
+		}
+		if instance.Metadata != nil {
+			for _, item := range instance.Metadata.Items {
+				if item.Key == runnerLabelsMetadataKey && item.Value != nil {
+					runner.Labels = strings.Split(*item.Value, ",")
+				}
+			}
+		}
+		changedAt, err := strconv.ParseInt(instance.Labels["status-changed"], 10, 64)
+		if err == nil {
+			runner.LastStateChange = time.Unix(changedAt, 0)
+		}
+		switch {
+		case instance.Status == "STOPPING" || instance.Status == "STOPPED" || instance.Status == "TERMINATED":
+			runner.State = interfaces.RunnerStateStopped
+		case labelStatus == "active":
+			runner.State = interfaces.RunnerStateActive
+		case labelStatus == "idle":
+			runner.State = interfaces.RunnerStateIdle
+		}
+		runners = append(runners, runner)
+	}
+	return runners, nil
+}
@@ -0,0 +1,222 @@
+package gcp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/providertest"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	"gopkg.in/stretchr/testify.v1/require"
+)
+
+// newTestProvider creates a provider using server with the defaults of opts
+func newTestProvider(t *testing.T, server *fakeCompute, opts Options) *Provider {
+	opts.Project = "project"
+	opts.Zone = "us-central1-a"
+	opts.Endpoint = server.Endpoint()
+	opts.ClientOptions = []option.ClientOption{option.WithoutAuthentication()}
+	opts.PollInterval = time.Millisecond
+	p, err := New(opts)
+	require.NoError(t, err)
+	p.cloudInitPrepare = func(ctx context.Context, opts interfaces.PrepareOptions) (string, error) {
+		return "#cloud-config\n", nil
+	}
+	return p
+}
+
+func (f *fakeCompute) addPoolImage(p *Provider, name string) {
+	f.addImage(name, map[string]string{"type": typeLabelValue, "pool": p.pool})
+}
+
+func TestProvider(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) providertest.Harness {
+		server := newFakeCompute(t)
+		p := newTestProvider(t, server, Options{})
+		return providertest.Harness{
+			Provider: p,
+			AddImage: func(t *testing.T) {
+				server.addPoolImage(p, p.namePrefix+"-image")
+			},
+			SetState: func(t *testing.T, id string, state interfaces.RunnerState) {
+				require.NoError(t, server.setLabel(id, "status", string(state)))
+			},
+			AddUnmanaged: func(t *testing.T) []string {
+				server.addInstance("database", "RUNNING", map[string]string{})
+				server.addInstance(typeLabelValue+"-other-abcde", "RUNNING", map[string]string{"type": typeLabelValue, "pool": "other"})
+				server.addInstance(p.namePrefix+"-prepare", "RUNNING", map[string]string{"type": typeLabelValue, "pool": p.pool, "status": labelStatusPreparing})
+				return []string{"database", typeLabelValue + "-other-abcde", p.namePrefix + "-prepare"}
+			},
+			Exists: func(t *testing.T, id string) bool {
+				return server.instance(id) != nil
+			},
+		}
+	})
+}
+
+func TestPrepareImage(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeCompute(t)
+	p := newTestProvider(t, server, Options{Pool: "build"})
+	server.addPoolImage(p, p.namePrefix+"-old")
+	// images of other pools are kept
+	server.addImage(typeLabelValue+"-other", map[string]string{"type": typeLabelValue, "pool": "other"})
+
+	require.NoError(t, p.PrepareImage(ctx, interfaces.PrepareOptions{}))
+
+	names := server.imageNames()
+	require.Len(t, names, 2)
+	require.True(t, strings.HasPrefix(names[0], p.namePrefix+"-"))
+	require.Equal(t, typeLabelValue+"-other", names[1])
+	require.Nil(t, server.instance(p.namePrefix+"-prepare"))
+
+	images, err := p.ListImages(ctx)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	require.True(t, images[0].Current)
+}
+
+func TestCreateRunnerFromTemplate(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeCompute(t)
+	server.addTemplate(&compute.InstanceTemplate{
+		Name: "runner-template",
+		Properties: &compute.InstanceProperties{
+			MachineType: "n2-standard-8",
+			Disks: []*compute.AttachedDisk{
+				{Type: "SCRATCH", Interface: "NVME"},
+				{Boot: true, InitializeParams: &compute.AttachedDiskInitializeParams{SourceImage: "ubuntu"}},
+			},
+		},
+	})
+	p := newTestProvider(t, server, Options{InstanceTemplate: "runner-template"})
+	server.addPoolImage(p, p.namePrefix+"-image")
+
+	id, err := p.CreateRunner(ctx, "https://github.com/org/repo", "token", "self-hosted,large")
+	require.NoError(t, err)
+	instance := server.instance(id)
+	require.Equal(t, "runner-template", server.sourceTemplate(id))
+	require.Equal(t, "n2-standard-8", instance.MachineType)
+	require.Len(t, instance.Disks, 2)
+	require.Equal(t, "projects/project/global/images/"+p.namePrefix+"-image", instance.Disks[1].InitializeParams.SourceImage)
+
+	p = newTestProvider(t, server, Options{InstanceTemplate: "missing"})
+	_, err = p.CreateRunner(ctx, "https://github.com/org/repo", "token", "self-hosted")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "get instance template")
+}
+
+func TestOperationErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		operationType string
+		call          func(ctx context.Context, p *Provider, server *fakeCompute) error
+		wantErr       string
+	}{
+		{
+			name:          "create runner",
+			operationType: "insert",
+			call: func(ctx context.Context, p *Provider, server *fakeCompute) error {
+				_, err := p.CreateRunner(ctx, "https://github.com/org/repo", "token", "self-hosted")
+				return err
+			},
+			wantErr: "wait for instance creation: operation",
+		},
+		{
+			name:          "delete runner",
+			operationType: "delete",
+			call: func(ctx context.Context, p *Provider, server *fakeCompute) error {
+				server.addInstance(p.namePrefix+"-runner", "RUNNING", map[string]string{"type": typeLabelValue, "pool": p.pool})
+				_, err := p.DeleteRunnersByID(ctx, []string{p.namePrefix + "-runner"}, interfaces.DeleteForce, true)
+				return err
+			},
+			wantErr: "operation",
+		},
+		{
+			name:          "prepare image",
+			operationType: "insert",
+			call: func(ctx context.Context, p *Provider, server *fakeCompute) error {
+				return p.PrepareImage(ctx, interfaces.PrepareOptions{})
+			},
+			wantErr: "wait for instance creation: operation",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeCompute(t)
+			server.pollsUntilDone = 1
+			p := newTestProvider(t, server, Options{})
+			server.addPoolImage(p, p.namePrefix+"-image")
+			server.failNext(tt.operationType, "QUOTA_EXCEEDED", "Quota 'CPUS' exceeded")
+
+			err := tt.call(context.Background(), p, server)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.wantErr)
+			require.Contains(t, err.Error(), "QUOTA_EXCEEDED: Quota 'CPUS' exceeded")
+		})
+	}
+}
+
+func TestPagination(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeCompute(t)
+	server.pageSize = 2
+	p := newTestProvider(t, server, Options{})
+	for _, name := range []string{"a", "b", "c"} {
+		server.addPoolImage(p, p.namePrefix+"-"+name)
+	}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		server.addInstance(p.namePrefix+"-"+name, "RUNNING", map[string]string{"type": typeLabelValue, "pool": p.pool, "status": "idle"})
+	}
+
+	images, err := p.ListImages(ctx)
+	require.NoError(t, err)
+	require.Len(t, images, 3)
+	runners, err := p.ListRunners(ctx)
+	require.NoError(t, err)
+	require.Len(t, runners, 5)
+	metrics, err := p.RunnerDisposition(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 5, metrics.IdleCount())
+}
+
+func TestInstanceStates(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeCompute(t)
+	p := newTestProvider(t, server, Options{})
+	instances := []struct {
+		name, status, label string
+	}{
+		{"unlabeled", "PROVISIONING", ""},
+		{"starting", "RUNNING", labelStatusStarting},
+		{"idle", "RUNNING", "idle"},
+		{"active", "RUNNING", "active"},
+		{"preparing", "RUNNING", labelStatusPreparing},
+		{"stopped", "TERMINATED", "idle"},
+	}
+	for _, instance := range instances {
+		labels := map[string]string{"type": typeLabelValue, "pool": p.pool}
+		if instance.label != "" {
+			labels["status"] = instance.label
+		}
+		server.addInstance(p.namePrefix+"-"+instance.name, instance.status, labels)
+	}
+
+	metrics, err := p.RunnerDisposition(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, metrics.StartingCount())
+	require.Equal(t, 1, metrics.IdleCount())
+	require.Equal(t, 1, metrics.ActiveCount())
+	require.Equal(t, 1, metrics.(disposition).PreparingCount())
+	require.Equal(t, 5, metrics.TotalCount())
+
+	deleted, err := p.DeleteRunners(ctx, len(instances), true)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{p.namePrefix + "-unlabeled", p.namePrefix + "-starting", p.namePrefix + "-idle"}, deleted)
+	for _, name := range []string{"active", "preparing", "stopped"} {
+		require.NotNil(t, server.instance(p.namePrefix+"-"+name), name)
+	}
+}
@@ -0,0 +1,99 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/leader"
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+)
+
+const leaderLeaseObject = "actions-runner-leader"
+const leaderLeaseMetadataKey = "lease"
+
+// Lease is a leader election lease stored in the metadata of a GCS object.
+// Updates use the object generation so concurrent writers can't both win.
+// Unlike project metadata, the object isn't propagated to any VM.
+type Lease struct {
+	client *storage.Service
+	bucket string
+}
+
+// NewLease creates a lease in an existing bucket
+func NewLease(bucket string) (*Lease, error) {
+	if bucket == "" {
+		return nil, errors.New("a GCS bucket is required")
+	}
+	client, err := storage.NewService(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("create storage client: %w", err)
+	}
+	return &Lease{client: client, bucket: bucket}, nil
+}
+
+func (l *Lease) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	return l.update(ctx, func(record leader.Record) (leader.Record, bool) {
+		if !record.Available(holder, time.Now()) {
+			return record, false
+		}
+		return leader.Record{Holder: holder, Expires: time.Now().Add(ttl)}, true
+	})
+}
+
+func (l *Lease) Release(ctx context.Context, holder string) error {
+	_, err := l.update(ctx, func(record leader.Record) (leader.Record, bool) {
+		if record.Holder != holder {
+			return record, false
+		}
+		return leader.Record{}, true
+	})
+	return err
+}
+
+// update writes the record returned by fn if it returns true
+func (l *Lease) update(ctx context.Context, fn func(leader.Record) (leader.Record, bool)) (bool, error) {
+	// a generation of 0 only matches if the object doesn't exist yet
+	var generation int64
+	value := ""
+	object, err := l.client.Objects.Get(l.bucket, leaderLeaseObject).Context(ctx).Do()
+	if err == nil {
+		generation = object.Generation
+		value = object.Metadata[leaderLeaseMetadataKey]
+	} else if !hasStatus(err, http.StatusNotFound) {
+		return false, fmt.Errorf("get lease object: %w", err)
+	}
+	record, err := leader.ParseRecord(value)
+	if err != nil {
+		return false, err
+	}
+	record, ok := fn(record)
+	if !ok {
+		return false, nil
+	}
+	value = ""
+	if record.Holder != "" {
+		value = record.String()
+	}
+	_, err = l.client.Objects.Insert(l.bucket, &storage.Object{
+		Name:     leaderLeaseObject,
+		Metadata: map[string]string{leaderLeaseMetadataKey: value},
+	}).IfGenerationMatch(generation).Media(strings.NewReader("")).Context(ctx).Do()
+	if hasStatus(err, http.StatusPreconditionFailed) {
+		// another replica updated the lease first
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("write lease object: %w", err)
+	}
+	return true, nil
+}
+
+func hasStatus(err error, code int) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
@@ -0,0 +1,45 @@
+package githubdemand
+
+import (
+	"strings"
+)
+
+// defaultRunnerLabels are registered by config.sh on every runner in
+// addition to the custom labels. The architecture label differs between pools
+// so it is part of the labels of each pool.
+var defaultRunnerLabels = []string{"self-hosted", "linux"}
+
+// labelsMatch returns true if every label a job requested in runs-on is
+// provided by a runner with runnerLabels
+func labelsMatch(jobLabels, runnerLabels []string) bool {
+	available := make(map[string]bool, len(runnerLabels)+len(defaultRunnerLabels))
+	for _, label := range append(runnerLabels, defaultRunnerLabels...) {
+		available[strings.ToLower(strings.TrimSpace(label))] = true
+	}
+	for _, label := range jobLabels {
+		if !available[strings.ToLower(strings.TrimSpace(label))] {
+			return false
+		}
+	}
+	return true
+}
+
+// assignJobs counts the jobs with the runs-on labels of jobs which each pool of
+// runners with poolLabels should run. Every job is counted for the matching
+// pool with the fewest labels, or the first of those, so that a job which
+// several pools could run creates a single runner which fits it best.
+func assignJobs(jobs [][]string, poolLabels [][]string) []int {
+	counts := make([]int, len(poolLabels))
+	for _, job := range jobs {
+		best := -1
+		for i, labels := range poolLabels {
+			if labelsMatch(job, labels) && (best == -1 || len(labels) < len(poolLabels[best])) {
+				best = i
+			}
+		}
+		if best != -1 {
+			counts[best]++
+		}
+	}
+	return counts
+}
@@ -0,0 +1,58 @@
+package githubdemand
+
+import (
+	"testing"
+
+	"gopkg.in/stretchr/testify.v1/require"
+)
+
+func TestAssignJobs(t *testing.T) {
+	tests := []struct {
+		name  string
+		jobs  [][]string
+		pools [][]string
+		want  []int
+	}{
+		{
+			name:  "no pools",
+			jobs:  [][]string{{"self-hosted"}},
+			pools: nil,
+			want:  []int{},
+		},
+		{
+			name:  "default labels match every pool once",
+			jobs:  [][]string{{"self-hosted"}, {"self-hosted", "linux", "x64"}},
+			pools: [][]string{{"build", "large", "x64"}, {"lint", "x64"}},
+			want:  []int{0, 2},
+		},
+		{
+			name:  "architecture of the pool",
+			jobs:  [][]string{{"self-hosted", "ARM64"}, {"self-hosted", "x64"}},
+			pools: [][]string{{"build", "x64"}, {"build", "arm64"}},
+			want:  []int{1, 1},
+		},
+		{
+			name:  "pool with the fewest labels",
+			jobs:  [][]string{{"self-hosted", "build"}, {"Build", "LARGE"}, {"lint"}},
+			pools: [][]string{{"lint"}, {"build", "large"}, {"build"}},
+			want:  []int{1, 1, 1},
+		},
+		{
+			name:  "first pool on a tie",
+			jobs:  [][]string{{"self-hosted"}},
+			pools: [][]string{{"a"}, {"b"}},
+			want:  []int{1, 0},
+		},
+		{
+			name:  "unmatched jobs are not counted",
+			jobs:  [][]string{{"windows"}, {"self-hosted", "gpu"}},
+			pools: [][]string{{"build"}},
+			want:  []int{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, assignJobs(tt.jobs, tt.pools))
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package githubdemand
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v68/github"
+)
+
+// stop polling when fewer requests than this remain so that token and
+// registration calls still succeed
+const minRateRemaining = 100
+
+// PollingProvider periodically lists queued jobs for a repository. It's
+// intended for deployments which cannot receive webhooks.
+type PollingProvider struct {
+	Client   *github.Client
+	Org      string
+	Repo     string
+	Interval time.Duration
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+
+	mu     sync.Mutex
+	queued [][]string
+	// polledAt is when queued was listed
+	polledAt    time.Time
+	lastErr     error
+	rateResetAt time.Time
+}
+
+func (p *PollingProvider) now() time.Time {
+	if p.Now == nil {
+		return time.Now()
+	}
+	return p.Now()
+}
+
+// Run polls until ctx is cancelled
+func (p *PollingProvider) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		err := p.poll(ctx)
+		p.mu.Lock()
+		p.lastErr = err
+		p.mu.Unlock()
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("error when polling queued jobs", "error", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *PollingProvider) poll(ctx context.Context) error {
+	p.mu.Lock()
+	rateResetAt := p.rateResetAt
+	p.mu.Unlock()
+	if p.now().Before(rateResetAt) {
+		return nil
+	}
+	startedAt := p.now()
+
+	var queued [][]string
+	// jobs in in_progress runs may still be queued (matrix builds, dependent jobs)
+	for _, status := range []string{"queued", "in_progress"} {
+		runOpts := &github.ListWorkflowRunsOptions{
+			Status:              status,
+			ExcludePullRequests: true,
+			ListOptions:         github.ListOptions{PerPage: 100},
+		}
+		for {
+			runs, resp, err := p.Client.Actions.ListRepositoryWorkflowRuns(ctx, p.Org, p.Repo, runOpts)
+			if err != nil {
+				return p.handleError(fmt.Errorf("list %s workflow runs: %w", status, err))
+			}
+			p.checkRate(resp)
+			for _, run := range runs.WorkflowRuns {
+				jobLabels, err := p.queuedJobs(ctx, run.GetID())
+				if err != nil {
+					return p.handleError(err)
+				}
+				queued = append(queued, jobLabels...)
+			}
+			if resp.NextPage == 0 {
+				break
+			}
+			runOpts.Page = resp.NextPage
+		}
+	}
+
+	p.mu.Lock()
+	p.queued = queued
+	p.polledAt = startedAt
+	p.mu.Unlock()
+	return nil
+}
+
+// queuedJobs returns the labels of every queued job in a workflow run
+func (p *PollingProvider) queuedJobs(ctx context.Context, runID int64) ([][]string, error) {
+	var queued [][]string
+	jobOpts := &github.ListWorkflowJobsOptions{
+		Filter:      "latest",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		jobs, resp, err := p.Client.Actions.ListWorkflowJobs(ctx, p.Org, p.Repo, runID, jobOpts)
+		if err != nil {
+			return nil, fmt.Errorf("list jobs for run %d: %w", runID, err)
+		}
+		p.checkRate(resp)
+		for _, job := range jobs.Jobs {
+			if job.GetStatus() == "queued" {
+				queued = append(queued, job.Labels)
+			}
+		}
+		if resp.NextPage == 0 {
+			return queued, nil
+		}
+		jobOpts.Page = resp.NextPage
+	}
+}
+
+// checkRate pauses polling until the rate limit resets if we are running low
+func (p *PollingProvider) checkRate(resp *github.Response) {
+	if resp == nil || resp.Rate.Limit == 0 || resp.Rate.Remaining >= minRateRemaining {
+		return
+	}
+	p.mu.Lock()
+	p.rateResetAt = resp.Rate.Reset.Time
+	p.mu.Unlock()
+}
+
+func (p *PollingProvider) handleError(err error) error {
+	var rateLimitErr *github.RateLimitError
+	var abuseErr *github.AbuseRateLimitError
+	resetAt := time.Time{}
+	if errors.As(err, &rateLimitErr) {
+		resetAt = rateLimitErr.Rate.Reset.Time
+	} else if errors.As(err, &abuseErr) {
+		resetAt = p.now().Add(abuseErr.GetRetryAfter())
+	}
+	if !resetAt.IsZero() {
+		p.mu.Lock()
+		p.rateResetAt = resetAt
+		p.mu.Unlock()
+	}
+	return err
+}
+
+// PendingJobs returns the number of queued jobs from the last successful poll
+// for each pool of runners with the provided labels. Jobs may have started or
+// been canceled since, so there is no demand once a poll was missed, for
+// example while polling is paused by the rate limit.
+func (p *PollingProvider) PendingJobs(ctx context.Context, poolLabels [][]string) ([]int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.polledAt.IsZero() {
+		return make([]int, len(poolLabels)), p.lastErr
+	}
+	age := p.now().Sub(p.polledAt)
+	if age > p.Interval*2 {
+		err := fmt.Errorf("queued jobs were last polled %s ago", age.Round(time.Second))
+		return make([]int, len(poolLabels)), errors.Join(err, p.lastErr)
+	}
+	return assignJobs(p.queued, poolLabels), p.lastErr
+}
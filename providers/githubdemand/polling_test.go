@@ -0,0 +1,161 @@
+package githubdemand
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v68/github"
+	"gopkg.in/stretchr/testify.v1/require"
+)
+
+// testGitHub serves workflow runs and jobs like the GitHub API
+type testGitHub struct {
+	mu sync.Mutex
+	// runs are the IDs of workflow runs by status
+	runs map[string][]int64
+	// jobs are the jobs of each workflow run
+	jobs          map[int64][]*github.WorkflowJob
+	rateRemaining int
+	rateReset     time.Time
+	status        int
+	requests      int
+}
+
+func (g *testGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.requests++
+	w.Header().Set("X-RateLimit-Limit", "5000")
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(g.rateRemaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(g.rateReset.Unix(), 10))
+	if g.status != 0 {
+		http.Error(w, "unavailable", g.status)
+		return
+	}
+	var body any
+	var runID int64
+	switch {
+	case r.URL.Path == "/repos/org/repo/actions/runs":
+		runs := &github.WorkflowRuns{}
+		for _, id := range g.runs[r.URL.Query().Get("status")] {
+			runs.WorkflowRuns = append(runs.WorkflowRuns, &github.WorkflowRun{ID: github.Ptr(id)})
+		}
+		body = runs
+	case parsePath(r.URL.Path, "/repos/org/repo/actions/runs/%d/jobs", &runID):
+		body = &github.Jobs{Jobs: g.jobs[runID]}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func parsePath(path, format string, id *int64) bool {
+	var rest string
+	n, _ := fmt.Sscanf(path+" end", format+" %s", id, &rest)
+	return n == 2 && rest == "end"
+}
+
+func testJob(status string, labels ...string) *github.WorkflowJob {
+	return &github.WorkflowJob{Status: github.Ptr(status), Labels: labels}
+}
+
+func newTestPollingProvider(t *testing.T, api *testGitHub, now func() time.Time) *PollingProvider {
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	client := github.NewClient(nil)
+	baseURL, err := url.Parse(server.URL + "/")
+	require.NoError(t, err)
+	client.BaseURL = baseURL
+	return &PollingProvider{Client: client, Org: "org", Repo: "repo", Interval: time.Minute, Now: now}
+}
+
+func TestPollingPendingJobs(t *testing.T) {
+	api := &testGitHub{
+		runs: map[string][]int64{"queued": {1}, "in_progress": {2}},
+		jobs: map[int64][]*github.WorkflowJob{
+			1: {testJob("queued", "self-hosted", "build")},
+			// a matrix build with one job still waiting for a runner
+			2: {testJob("in_progress", "self-hosted", "build"), testJob("queued", "self-hosted", "build"), testJob("queued", "gpu")},
+		},
+		rateRemaining: 5000,
+	}
+	p := newTestPollingProvider(t, api, time.Now)
+
+	pending, err := p.PendingJobs(context.Background(), testPoolLabels)
+	require.NoError(t, err)
+	require.Equal(t, []int{0}, pending)
+
+	require.NoError(t, p.poll(context.Background()))
+	pending, err = p.PendingJobs(context.Background(), testPoolLabels)
+	require.NoError(t, err)
+	require.Equal(t, []int{2}, pending)
+}
+
+func TestPollingRateLimit(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	api := &testGitHub{
+		runs:          map[string][]int64{"queued": {1}},
+		jobs:          map[int64][]*github.WorkflowJob{1: {testJob("queued", "self-hosted", "build")}},
+		rateRemaining: minRateRemaining - 1,
+		rateReset:     now.Add(time.Hour),
+	}
+	p := newTestPollingProvider(t, api, func() time.Time { return now })
+	ctx := context.Background()
+
+	require.NoError(t, p.poll(ctx))
+	requests := api.requests
+	pending, err := p.PendingJobs(ctx, testPoolLabels)
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, pending)
+
+	// polling is paused until the rate limit resets and the last jobs
+	// expire once a poll was missed
+	now = now.Add(p.Interval * 3)
+	require.NoError(t, p.poll(ctx))
+	require.Equal(t, requests, api.requests)
+	pending, err = p.PendingJobs(ctx, testPoolLabels)
+	require.Error(t, err)
+	require.Equal(t, []int{0}, pending)
+
+	now = now.Add(time.Hour)
+	api.rateRemaining = 5000
+	require.NoError(t, p.poll(ctx))
+	pending, err = p.PendingJobs(ctx, testPoolLabels)
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, pending)
+}
+
+func TestPollingErrors(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	api := &testGitHub{
+		runs:          map[string][]int64{"queued": {1}},
+		jobs:          map[int64][]*github.WorkflowJob{1: {testJob("queued", "self-hosted", "build")}},
+		rateRemaining: 5000,
+	}
+	p := newTestPollingProvider(t, api, func() time.Time { return now })
+	ctx := context.Background()
+	require.NoError(t, p.poll(ctx))
+
+	// the last jobs are used until a poll was missed
+	api.status = http.StatusServiceUnavailable
+	p.lastErr = p.poll(ctx)
+	require.Error(t, p.lastErr)
+	pending, err := p.PendingJobs(ctx, testPoolLabels)
+	require.Error(t, err)
+	require.Equal(t, []int{1}, pending)
+
+	now = now.Add(p.Interval * 3)
+	pending, err = p.PendingJobs(ctx, testPoolLabels)
+	require.Error(t, err)
+	require.Equal(t, []int{0}, pending)
+}
@@ -0,0 +1,161 @@
+package githubdemand
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/journal"
+	"github.com/google/go-github/v68/github"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GitHub cancels jobs which have been queued for longer than 24 hours. Forget
+// about jobs older than that in case we missed the in_progress or completed
+// delivery.
+const queuedJobTimeout = time.Hour * 24
+
+// GitHub doesn't guarantee the order of deliveries and may redeliver them.
+// This many started jobs are remembered so that a late queued delivery doesn't
+// count them again.
+const startedJobsLimit = 10000
+
+type queuedJob struct {
+	labels   []string
+	queuedAt time.Time
+}
+
+// WebhookProvider tracks queued jobs from workflow_job webhook deliveries
+type WebhookProvider struct {
+	secret  []byte
+	events  *prometheus.CounterVec
+	journal *journal.Journal
+
+	mu     sync.Mutex
+	queued map[int64]queuedJob
+	// started are jobs which are in progress or completed. startedOrder
+	// evicts the oldest once there are more than startedJobsLimit.
+	started      map[int64]bool
+	startedOrder []int64
+}
+
+// NewWebhookProvider creates a provider which verifies deliveries with secret.
+// The webhook event counter is registered with reg and job events are recorded
+// to j, which may be nil.
+func NewWebhookProvider(secret []byte, reg prometheus.Registerer, j *journal.Journal) *WebhookProvider {
+	events := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "actions_runner_autoscaler",
+		Name:      "workflow_job_events_total",
+		Help:      "Number of workflow_job webhook deliveries by action",
+	}, []string{"action"})
+	reg.MustRegister(events)
+	return &WebhookProvider{
+		secret:  secret,
+		events:  events,
+		journal: j,
+		queued:  make(map[int64]queuedJob),
+		started: make(map[int64]bool),
+	}
+}
+
+func (p *WebhookProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload, err := github.ValidatePayload(r, p.secret)
+	if err != nil {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	event, err := github.ParseWebHook(github.WebHookType(r), payload)
+	if err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	switch e := event.(type) {
+	case *github.WorkflowJobEvent:
+		p.handleWorkflowJob(e)
+	case *github.PingEvent:
+		slog.Info("received webhook ping")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *WebhookProvider) handleWorkflowJob(e *github.WorkflowJobEvent) {
+	job := e.GetWorkflowJob()
+	id := job.GetID()
+	p.events.WithLabelValues(e.GetAction()).Inc()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch e.GetAction() {
+	case "queued":
+		if p.started[id] {
+			slog.Debug("ignoring queued delivery of a started job", "job", id)
+			return
+		}
+		p.queued[id] = queuedJob{
+			labels:   job.Labels,
+			queuedAt: job.GetCreatedAt().Time,
+		}
+	case "in_progress", "completed":
+		delete(p.queued, id)
+		p.setStarted(id)
+	}
+	p.recordJob(e.GetAction(), job)
+}
+
+// recordJob writes a journal event for a job. The instance is the runner name
+// since runners are named after the hostname of their instance.
+func (p *WebhookProvider) recordJob(action string, job *github.WorkflowJob) {
+	event := journal.Event{JobID: job.GetID(), Instance: job.GetRunnerName()}
+	createdAt, startedAt, completedAt := job.GetCreatedAt().Time, job.GetStartedAt().Time, job.GetCompletedAt().Time
+	switch action {
+	case "queued":
+		event.Type = journal.JobQueued
+	case "in_progress":
+		event.Type = journal.JobStarted
+		if !createdAt.IsZero() && !startedAt.IsZero() {
+			event.DurationSeconds = startedAt.Sub(createdAt).Seconds()
+		}
+	case "completed":
+		event.Type = journal.JobCompleted
+		if !startedAt.IsZero() && !completedAt.IsZero() {
+			event.DurationSeconds = completedAt.Sub(startedAt).Seconds()
+		}
+	default:
+		return
+	}
+	err := p.journal.Record(event)
+	if err != nil {
+		slog.Warn("error when writing journal", "error", err)
+	}
+}
+
+// setStarted remembers a started job. The caller must hold mu.
+func (p *WebhookProvider) setStarted(id int64) {
+	if p.started[id] {
+		return
+	}
+	p.started[id] = true
+	p.startedOrder = append(p.startedOrder, id)
+	if len(p.startedOrder) > startedJobsLimit {
+		delete(p.started, p.startedOrder[0])
+		p.startedOrder = p.startedOrder[1:]
+	}
+}
+
+// PendingJobs returns the number of queued jobs for each pool of runners with
+// the provided labels
+func (p *WebhookProvider) PendingJobs(ctx context.Context, poolLabels [][]string) ([]int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var jobs [][]string
+	for id, job := range p.queued {
+		if time.Since(job.queuedAt) > queuedJobTimeout {
+			delete(p.queued, id)
+			continue
+		}
+		jobs = append(jobs, job.labels)
+	}
+	return assignJobs(jobs, poolLabels), nil
+}
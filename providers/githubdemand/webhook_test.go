@@ -0,0 +1,147 @@
+package githubdemand
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/journal"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/stretchr/testify.v1/require"
+)
+
+var testSecret = []byte("secret")
+
+var testPoolLabels = [][]string{{"self-hosted", "build"}}
+
+func deliver(t *testing.T, p *WebhookProvider, event string, payload any, secret []byte) int {
+	body, err := json.Marshal(payload)
+	require.NoError(t, err)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	req := httptest.NewRequest("POST", "/webhook", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", event)
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func workflowJob(action string, id int64, createdAt time.Time) map[string]any {
+	return map[string]any{
+		"action": action,
+		"workflow_job": map[string]any{
+			"id":         id,
+			"labels":     []string{"self-hosted", "build"},
+			"created_at": createdAt.Format(time.RFC3339),
+		},
+	}
+}
+
+func pendingJobs(t *testing.T, p *WebhookProvider) int {
+	pending, err := p.PendingJobs(context.Background(), testPoolLabels)
+	require.NoError(t, err)
+	return pending[0]
+}
+
+func TestWebhookRequests(t *testing.T) {
+	tests := []struct {
+		name       string
+		event      string
+		payload    any
+		secret     []byte
+		wantStatus int
+	}{
+		{name: "ping", event: "ping", payload: map[string]any{"zen": "Keep it simple."}, secret: testSecret, wantStatus: http.StatusNoContent},
+		{name: "workflow job", event: "workflow_job", payload: workflowJob("queued", 1, time.Now()), secret: testSecret, wantStatus: http.StatusNoContent},
+		{name: "invalid signature", event: "workflow_job", payload: workflowJob("queued", 1, time.Now()), secret: []byte("wrong"), wantStatus: http.StatusUnauthorized},
+		{name: "unknown event", event: "not_an_event", payload: map[string]any{}, secret: testSecret, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewWebhookProvider(testSecret, prometheus.NewRegistry(), nil)
+			require.Equal(t, tt.wantStatus, deliver(t, p, tt.event, tt.payload, tt.secret))
+		})
+	}
+}
+
+func TestWebhookJobs(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []string
+		age     time.Duration
+		want    int
+	}{
+		{name: "queued", actions: []string{"queued"}, want: 1},
+		{name: "in progress", actions: []string{"queued", "in_progress"}},
+		{name: "completed", actions: []string{"queued", "in_progress", "completed"}},
+		{name: "queued delivered late", actions: []string{"in_progress", "queued"}},
+		{name: "queued redelivered", actions: []string{"queued", "completed", "queued"}},
+		{name: "expired", actions: []string{"queued"}, age: queuedJobTimeout + time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewWebhookProvider(testSecret, prometheus.NewRegistry(), nil)
+			for _, action := range tt.actions {
+				payload := workflowJob(action, 1, time.Now().Add(-tt.age))
+				require.Equal(t, http.StatusNoContent, deliver(t, p, "workflow_job", payload, testSecret))
+			}
+			require.Equal(t, tt.want, pendingJobs(t, p))
+		})
+	}
+}
+
+func TestWebhookStartedJobsLimit(t *testing.T) {
+	p := NewWebhookProvider(testSecret, prometheus.NewRegistry(), nil)
+	for id := int64(0); id <= startedJobsLimit; id++ {
+		p.setStarted(id)
+	}
+	require.Len(t, p.started, startedJobsLimit)
+	require.False(t, p.started[0])
+	require.True(t, p.started[startedJobsLimit])
+}
+
+func TestWebhookJournal(t *testing.T) {
+	createdAt := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	startedAt := createdAt.Add(30 * time.Second)
+	completedAt := startedAt.Add(2 * time.Minute)
+	var buf bytes.Buffer
+	p := NewWebhookProvider(testSecret, prometheus.NewRegistry(), journal.New(&buf, func() time.Time { return completedAt }))
+
+	for _, action := range []string{"queued", "in_progress", "completed"} {
+		payload := workflowJob(action, 1, createdAt)
+		job := payload["workflow_job"].(map[string]any)
+		if action != "queued" {
+			job["runner_name"] = "actions-runner-ephemeral-build-abc"
+			job["started_at"] = startedAt.Format(time.RFC3339)
+		}
+		if action == "completed" {
+			job["completed_at"] = completedAt.Format(time.RFC3339)
+		}
+		require.Equal(t, http.StatusNoContent, deliver(t, p, "workflow_job", payload, testSecret))
+	}
+	// a late queued delivery is not recorded
+	require.Equal(t, http.StatusNoContent, deliver(t, p, "workflow_job", workflowJob("queued", 1, createdAt), testSecret))
+
+	var events []journal.Event
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var event journal.Event
+		require.NoError(t, dec.Decode(&event))
+		events = append(events, event)
+	}
+	require.Equal(t, []journal.Event{
+		{Time: completedAt, Type: journal.JobQueued, JobID: 1},
+		{Time: completedAt, Type: journal.JobStarted, JobID: 1, Instance: "actions-runner-ephemeral-build-abc", DurationSeconds: 30},
+		{Time: completedAt, Type: journal.JobCompleted, JobID: 1, Instance: "actions-runner-ephemeral-build-abc", DurationSeconds: 120},
+	}, events)
+}
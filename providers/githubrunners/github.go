@@ -0,0 +1,52 @@
+package githubrunners
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+	"github.com/google/go-github/v68/github"
+)
+
+// Registry lists the self-hosted runners registered with a repository, or
+// with an organization if Repo is empty
+type Registry struct {
+	Client *github.Client
+	Org    string
+	Repo   string
+}
+
+func (r *Registry) list(ctx context.Context, opts *github.ListRunnersOptions) (*github.Runners, *github.Response, error) {
+	if r.Repo == "" {
+		return r.Client.Actions.ListOrganizationRunners(ctx, r.Org, opts)
+	}
+	return r.Client.Actions.ListRunners(ctx, r.Org, r.Repo, opts)
+}
+
+// RegisteredRunners returns every registered runner
+func (r *Registry) RegisteredRunners(ctx context.Context) ([]interfaces.RegisteredRunner, error) {
+	var res []interfaces.RegisteredRunner
+	opts := &github.ListRunnersOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		runners, resp, err := r.list(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("listing runners: %w", err)
+		}
+		for _, runner := range runners.Runners {
+			var labels []string
+			for _, label := range runner.Labels {
+				labels = append(labels, label.GetName())
+			}
+			res = append(res, interfaces.RegisteredRunner{
+				Name:   runner.GetName(),
+				Status: runner.GetStatus(),
+				Busy:   runner.GetBusy(),
+				Labels: labels,
+			})
+		}
+		if resp.NextPage == 0 {
+			return res, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
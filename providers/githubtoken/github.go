@@ -24,3 +24,22 @@ func (p *RepoProvider) Token(ctx context.Context) (string, error) {
 	}
 	return tokenResponse.GetToken(), nil
 }
+
+// RemoveRunner deregisters the runner with the provided name. It's not an
+// error if the runner is not registered.
+func (p *RepoProvider) RemoveRunner(ctx context.Context, name string) error {
+	runners, _, err := p.Client.Actions.ListRunners(ctx, p.Org, p.Repo, &github.ListRunnersOptions{Name: &name})
+	if err != nil {
+		return fmt.Errorf("listing runners: %w", err)
+	}
+	for _, runner := range runners.Runners {
+		if runner.GetName() != name {
+			continue
+		}
+		_, err = p.Client.Actions.RemoveRunner(ctx, p.Org, p.Repo, runner.GetID())
+		if err != nil {
+			return fmt.Errorf("removing runner %s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -2,15 +2,22 @@ package interfaces
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
+// ErrRunnerNotFound is returned for IDs which are not runners of the
+// provider's pool
+var ErrRunnerNotFound = errors.New("runner not found")
+
 // RunnerDispositionMetrics represents the metrics of runner instances in different states
 type RunnerDispositionMetrics interface {
 	// TotalCount returns the total number of runner instances
 	TotalCount() int
 
-	// StartingCount returns the number of runner instances in starting state
+	// StartingCount returns the number of runner instances in starting state.
+	// Instances whose state is unknown are counted as starting so that the
+	// capacity limits still apply to them.
 	StartingCount() int
 
 	// IdleCount returns the number of runner instances in idle state
@@ -26,18 +33,93 @@ type Provider interface {
 	// PrepareImage preheats an image with required packages
 	PrepareImage(ctx context.Context, opts PrepareOptions) error
 
-	// CreateRunner creates a new runner instance
-	CreateRunner(ctx context.Context, url, token, labels string) error
+	// CreateRunner creates a new runner instance and returns its ID
+	CreateRunner(ctx context.Context, url, token, labels string) (string, error)
 
-	// DeleteRunners deletes N runner instances
+	// DeleteRunners deletes up to N idle or starting runner instances and
+	// returns the names of the deleted instances. Active runners are never
+	// deleted.
 	//
 	// wait should be set to true running in the autoscaler loop
-	DeleteRunners(ctx context.Context, count int, wait bool) error
+	DeleteRunners(ctx context.Context, count int, wait bool) ([]string, error)
+
+	// DeleteRunnersByID deletes runner instances by ID and returns the IDs
+	// which were deleted, even if it fails for others. Runners skipped by mode
+	// are not returned. Nothing is deleted if an ID is not a runner of the
+	// provider's pool and ErrRunnerNotFound is returned. If wait is true, it
+	// waits for the deletions to complete.
+	DeleteRunnersByID(ctx context.Context, ids []string, mode DeleteMode, wait bool) ([]string, error)
 
 	// RunnerDisposition returns the current state of runners
 	RunnerDisposition(ctx context.Context) (RunnerDispositionMetrics, error)
+
+	// ListRunners returns every runner instance
+	ListRunners(ctx context.Context) ([]Runner, error)
+
+	// ListImages returns the runner images which have not been cleaned up
+	ListImages(ctx context.Context) ([]Image, error)
+}
+
+// DeleteMode controls whether DeleteRunnersByID may interrupt a job
+type DeleteMode int
+
+const (
+	// DeleteIfNotActive reads the state of each runner right before deleting
+	// it and skips runners which are active or whose state can't be read.
+	// Runners picked from an earlier listing may have taken a job since.
+	DeleteIfNotActive DeleteMode = iota
+	// DeleteForce deletes runners regardless of their state
+	DeleteForce
+)
+
+type Image struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// Current is set for the image new runners are created from
+	Current bool `json:"current"`
 }
 
+type RunnerState string
+
+const (
+	RunnerStateStarting RunnerState = "starting"
+	RunnerStateIdle     RunnerState = "idle"
+	RunnerStateActive   RunnerState = "active"
+	RunnerStateStopped  RunnerState = "stopped"
+	// RunnerStateUnknown is used for running instances whose state can't be
+	// read. They may be running a job so they are never deleted unless forced.
+	RunnerStateUnknown RunnerState = "unknown"
+)
+
+// Runner describes a single runner instance
+type Runner struct {
+	ID        string      `json:"id"`
+	State     RunnerState `json:"state"`
+	CreatedAt time.Time   `json:"created_at"`
+	// LastStateChange is when the runner hooks last reported a state. It is
+	// zero if the runner has not reported a state yet.
+	LastStateChange time.Time `json:"last_state_change"`
+	// Labels are the labels the runner was registered with
+	Labels []string `json:"labels"`
+	// Metadata contains provider specific information for debugging
+	Metadata map[string]string `json:"metadata"`
+}
+
+// RegisteredRunner is a runner as registered with GitHub. Its name is the
+// hostname of the instance.
+type RegisteredRunner struct {
+	Name string `json:"name"`
+	// Status is online or offline
+	Status string `json:"status"`
+	// Busy is set while the runner is running a job
+	Busy   bool     `json:"busy"`
+	Labels []string `json:"labels"`
+}
+
+// DefaultPool is the name of the pool used when only one is configured.
+// Providers keep the resource names they used before pools existed for it.
+const DefaultPool = "default"
+
 type PrepareOptions struct {
 	CustomCloudInitOverlay string
 }
@@ -0,0 +1,242 @@
+package lxd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+)
+
+// fakeServer implements the parts of the LXD API used by the provider.
+// Calling any other method panics on the nil embedded interface.
+type fakeServer struct {
+	lxd.InstanceServer
+
+	mu        sync.Mutex
+	instances map[string]*api.Instance
+	// files are the files written inside instances by path
+	files   map[string]map[string]string
+	images  map[string]*api.Image
+	aliases map[string]string
+	// fileErr is returned when reading any file
+	fileErr error
+	// startErr is returned when starting any instance
+	startErr error
+	// onCreate is called after an instance is created
+	onCreate func()
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{
+		instances: make(map[string]*api.Instance),
+		files:     make(map[string]map[string]string),
+		images:    make(map[string]*api.Image),
+		aliases:   make(map[string]string),
+	}
+}
+
+type fakeOperation struct {
+	lxd.Operation
+	metadata map[string]any
+}
+
+func (o *fakeOperation) Wait() error {
+	return nil
+}
+
+func (o *fakeOperation) WaitContext(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (o *fakeOperation) Get() api.Operation {
+	return api.Operation{Status: "Success", Metadata: o.metadata}
+}
+
+// addImage adds an image and points alias at it
+func (s *fakeServer) addImage(alias string, properties map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fingerprint := fmt.Sprintf("%064d", len(s.images)+1)
+	s.images[fingerprint] = &api.Image{
+		Fingerprint: fingerprint,
+		CreatedAt:   time.Now(),
+		Properties:  properties,
+	}
+	s.aliases[alias] = fingerprint
+}
+
+// addInstance adds a running instance which wasn't created by the provider
+func (s *fakeServer) addInstance(name string, config map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.instances[name] = &api.Instance{
+		Name:       name,
+		Status:     "Running",
+		StatusCode: api.Running,
+		CreatedAt:  time.Now(),
+		Config:     config,
+	}
+	s.files[name] = make(map[string]string)
+}
+
+// writeFile writes a file inside an instance like the runner hooks do
+func (s *fakeServer) writeFile(name, path, content string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.instances[name] == nil {
+		return api.StatusErrorf(http.StatusNotFound, "Instance not found")
+	}
+	s.files[name][path] = content
+	return nil
+}
+
+// matchesFilter supports config.key=value filters
+func matchesFilter(instance *api.Instance, filters []string) bool {
+	for _, filter := range filters {
+		key, value, _ := strings.Cut(filter, "=")
+		key, ok := strings.CutPrefix(key, "config.")
+		if !ok || instance.Config[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *fakeServer) GetInstancesWithFilter(instanceType api.InstanceType, filters []string) ([]api.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []api.Instance
+	for _, instance := range s.instances {
+		if matchesFilter(instance, filters) {
+			res = append(res, *instance)
+		}
+	}
+	return res, nil
+}
+
+func (s *fakeServer) GetInstance(name string) (*api.Instance, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	instance := s.instances[name]
+	if instance == nil {
+		return nil, "", api.StatusErrorf(http.StatusNotFound, "Instance not found")
+	}
+	res := *instance
+	return &res, "", nil
+}
+
+func (s *fakeServer) GetInstanceFile(name string, path string) (io.ReadCloser, *lxd.InstanceFileResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fileErr != nil {
+		return nil, nil, s.fileErr
+	}
+	content, ok := s.files[name][path]
+	if !ok {
+		return nil, nil, api.StatusErrorf(http.StatusNotFound, "Not found")
+	}
+	return io.NopCloser(strings.NewReader(content)), &lxd.InstanceFileResponse{}, nil
+}
+
+func (s *fakeServer) CreateInstance(post api.InstancesPost) (lxd.Operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.instances[post.Name] != nil {
+		return nil, api.StatusErrorf(http.StatusConflict, "Instance %q already exists", post.Name)
+	}
+	if post.Source.Alias != "" && post.Source.Server == "" && s.aliases[post.Source.Alias] == "" {
+		return nil, api.StatusErrorf(http.StatusNotFound, "Image alias %q not found", post.Source.Alias)
+	}
+	s.instances[post.Name] = &api.Instance{
+		Name:       post.Name,
+		Status:     "Stopped",
+		StatusCode: api.Stopped,
+		CreatedAt:  time.Now(),
+		Ephemeral:  post.Ephemeral,
+		Profiles:   post.Profiles,
+		Config:     post.Config,
+	}
+	s.files[post.Name] = make(map[string]string)
+	if s.onCreate != nil {
+		s.onCreate()
+	}
+	return &fakeOperation{}, nil
+}
+
+func (s *fakeServer) UpdateInstanceState(name string, state api.InstanceStatePut, etag string) (lxd.Operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	instance := s.instances[name]
+	if instance == nil {
+		return nil, api.StatusErrorf(http.StatusNotFound, "Instance not found")
+	}
+	switch state.Action {
+	case "start":
+		if s.startErr != nil {
+			return nil, s.startErr
+		}
+		instance.Status, instance.StatusCode = "Running", api.Running
+	case "stop":
+		instance.Status, instance.StatusCode = "Stopped", api.Stopped
+		// ephemeral instances are deleted when they stop
+		if instance.Ephemeral {
+			delete(s.instances, name)
+			delete(s.files, name)
+		}
+	default:
+		return nil, api.StatusErrorf(http.StatusBadRequest, "Unknown action %q", state.Action)
+	}
+	return &fakeOperation{}, nil
+}
+
+func (s *fakeServer) DeleteInstance(name string) (lxd.Operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	instance := s.instances[name]
+	if instance == nil {
+		return nil, api.StatusErrorf(http.StatusNotFound, "Instance not found")
+	}
+	if instance.StatusCode != api.Stopped {
+		return nil, api.StatusErrorf(http.StatusBadRequest, "Instance is running")
+	}
+	delete(s.instances, name)
+	delete(s.files, name)
+	return &fakeOperation{}, nil
+}
+
+func (s *fakeServer) GetImageAlias(name string) (*api.ImageAliasesEntry, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	target, ok := s.aliases[name]
+	if !ok {
+		return nil, "", api.StatusErrorf(http.StatusNotFound, "Image alias not found")
+	}
+	return &api.ImageAliasesEntry{Name: name, Target: target}, "", nil
+}
+
+func (s *fakeServer) GetImage(fingerprint string) (*api.Image, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	image := s.images[fingerprint]
+	if image == nil {
+		return nil, "", api.StatusErrorf(http.StatusNotFound, "Image not found")
+	}
+	res := *image
+	return &res, "", nil
+}
+
+func (s *fakeServer) GetImages() ([]api.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []api.Image
+	for _, image := range s.images {
+		res = append(res, *image)
+	}
+	return res, nil
+}
@@ -0,0 +1,104 @@
+package lxd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	lxd "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/leader"
+)
+
+const leaderLeaseKey = "user.actions-runner-leader"
+
+// leaderLeaseProfile is not used by any instance. Changes to a profile are
+// applied to every instance using it.
+const leaderLeaseProfile = "actions-runner-leader"
+
+// Lease is a leader election lease stored in a config key of a dedicated
+// profile. Updates use the profile ETag so concurrent writers can't both win.
+type Lease struct {
+	client lxd.InstanceServer
+}
+
+// NewLease creates a lease in project which defaults to LXD_PROJECT
+func NewLease(project string) (*Lease, error) {
+	client, err := lxd.ConnectLXDUnix("", nil)
+	if err != nil {
+		return nil, err
+	}
+	if project == "" {
+		project = os.Getenv("LXD_PROJECT")
+	}
+	if project != "" {
+		client = client.UseProject(project)
+	}
+	return &Lease{client: client}, nil
+}
+
+func (l *Lease) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	return l.update(func(record leader.Record) (leader.Record, bool) {
+		if !record.Available(holder, time.Now()) {
+			return record, false
+		}
+		return leader.Record{Holder: holder, Expires: time.Now().Add(ttl)}, true
+	})
+}
+
+func (l *Lease) Release(ctx context.Context, holder string) error {
+	_, err := l.update(func(record leader.Record) (leader.Record, bool) {
+		if record.Holder != holder {
+			return record, false
+		}
+		return leader.Record{}, true
+	})
+	return err
+}
+
+// update writes the record returned by fn if it returns true
+func (l *Lease) update(fn func(leader.Record) (leader.Record, bool)) (bool, error) {
+	profile, etag, err := l.client.GetProfile(leaderLeaseProfile)
+	if api.StatusErrorCheck(err, http.StatusNotFound) {
+		err = l.client.CreateProfile(api.ProfilesPost{
+			Name:       leaderLeaseProfile,
+			ProfilePut: api.ProfilePut{Description: "Leader election lease of actions-runner-ephemeral-autoscaler"},
+		})
+		// another replica may have created it first
+		if err != nil && !api.StatusErrorCheck(err, http.StatusConflict) {
+			return false, fmt.Errorf("create profile: %w", err)
+		}
+		profile, etag, err = l.client.GetProfile(leaderLeaseProfile)
+	}
+	if err != nil {
+		return false, fmt.Errorf("get profile: %w", err)
+	}
+	record, err := leader.ParseRecord(profile.Config[leaderLeaseKey])
+	if err != nil {
+		return false, err
+	}
+	record, ok := fn(record)
+	if !ok {
+		return false, nil
+	}
+	put := profile.Writable()
+	if put.Config == nil {
+		put.Config = map[string]string{}
+	}
+	if record.Holder == "" {
+		delete(put.Config, leaderLeaseKey)
+	} else {
+		put.Config[leaderLeaseKey] = record.String()
+	}
+	err = l.client.UpdateProfile(leaderLeaseProfile, put, etag)
+	if api.StatusErrorCheck(err, http.StatusPreconditionFailed) {
+		// another replica updated the lease first
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("update profile: %w", err)
+	}
+	return true, nil
+}
@@ -2,10 +2,15 @@ package lxd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,36 +18,99 @@ import (
 	"github.com/canonical/lxd/shared/api"
 	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/common"
 	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/tracing"
 	"github.com/samber/lo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const actionsRunnerEphemeralKey = "user.actions-runner-ephemeral"
+const runnerPoolKey = "user.actions-runner-pool"
 const imageAliasName = "actions-runner-ephemeral"
+const runnerStatePath = "/tmp/actions-runner-state"
+const runnerLabelsKey = "user.actions-runner-labels"
+const imagePoolProperty = "actions-runner-pool"
+
+// removeFailedInstanceTimeout bounds cleaning up after a failed creation
+const removeFailedInstanceTimeout = time.Minute
+
+var tracer = otel.Tracer("github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/lxd")
+
+type Options struct {
+	// Pool scopes the instances and image managed by the provider so that
+	// multiple pools can share an LXD project
+	Pool string
+	// Project is the LXD project to use. It defaults to LXD_PROJECT.
+	Project string
+}
 
 type Provider struct {
 	client lxd.InstanceServer
+	pool   string
+	// imageAlias is also used as the prefix of instance names
+	imageAlias string
 }
 
-func New() (*Provider, error) {
+func New(opts Options) (*Provider, error) {
 	client, err := lxd.ConnectLXDUnix("", nil)
 	if err != nil {
 		return nil, err
 	}
 
-	projectName, ok := os.LookupEnv("LXD_PROJECT")
-	if ok {
-		client = client.UseProject(projectName)
+	if opts.Project == "" {
+		opts.Project = os.Getenv("LXD_PROJECT")
+	}
+	if opts.Project != "" {
+		client = client.UseProject(opts.Project)
+	}
+
+	if opts.Pool == "" {
+		opts.Pool = interfaces.DefaultPool
+	}
+	imageAlias := imageAliasName
+	if opts.Pool != interfaces.DefaultPool {
+		imageAlias = fmt.Sprintf("%s-%s", imageAliasName, opts.Pool)
 	}
 
 	return &Provider{
-		client: client,
+		client:     client,
+		pool:       opts.Pool,
+		imageAlias: imageAlias,
 	}, nil
 }
 
+// listInstances returns the runner instances in our pool. Instances created
+// before pools existed belong to the default pool.
+func (p *Provider) listInstances(ctx context.Context) ([]api.Instance, error) {
+	// the LXD client doesn't take a context
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	instances, err := p.client.GetInstancesWithFilter(api.InstanceTypeContainer, []string{fmt.Sprintf("config.%s=true", actionsRunnerEphemeralKey)})
+	if err != nil {
+		return nil, fmt.Errorf("getting instances: %w", err)
+	}
+	var res []api.Instance
+	for _, instance := range instances {
+		pool := instance.Config[runnerPoolKey]
+		if pool == "" {
+			pool = interfaces.DefaultPool
+		}
+		if pool == p.pool {
+			res = append(res, instance)
+		}
+	}
+	return res, nil
+}
+
 // ImageCreatedAt gets the creation timestamp of the latest image.
 // This is typically used to determine if we need to call PrepareImage.
 func (p *Provider) ImageCreatedAt(ctx context.Context) (time.Time, error) {
-	alias, _, err := p.client.GetImageAlias(imageAliasName)
+	if ctx.Err() != nil {
+		return time.Time{}, ctx.Err()
+	}
+	alias, _, err := p.client.GetImageAlias(p.imageAlias)
 	if err != nil {
 		if api.StatusErrorCheck(err, http.StatusNotFound) {
 			return time.Time{}, nil
@@ -56,10 +124,48 @@ func (p *Provider) ImageCreatedAt(ctx context.Context) (time.Time, error) {
 	return image.CreatedAt, nil
 }
 
+// CloudInitPrepare renders the cloud-init used to prepare images
+func CloudInitPrepare(ctx context.Context, opts interfaces.PrepareOptions) (string, error) {
+	return common.GetCloudInitPrepare(ctx, opts.CustomCloudInitOverlay)
+}
+
+// ListImages returns the images of our pool which have not expired. The
+// current image is the target of the image alias.
+func (p *Provider) ListImages(ctx context.Context) ([]interfaces.Image, error) {
+	current := ""
+	alias, _, err := p.client.GetImageAlias(p.imageAlias)
+	if err == nil {
+		current = alias.Target
+	} else if !api.StatusErrorCheck(err, http.StatusNotFound) {
+		return nil, fmt.Errorf("get image alias: %w", err)
+	}
+	images, err := p.client.GetImages()
+	if err != nil {
+		return nil, fmt.Errorf("get images: %w", err)
+	}
+	var res []interfaces.Image
+	for _, image := range images {
+		// images prepared before the pool property was set are only found
+		// through the alias
+		if image.Properties[imagePoolProperty] != p.pool && image.Fingerprint != current {
+			continue
+		}
+		res = append(res, interfaces.Image{
+			ID:        image.Fingerprint,
+			CreatedAt: image.CreatedAt,
+			Current:   image.Fingerprint == current,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.After(res[j].CreatedAt)
+	})
+	return res, nil
+}
+
 // PrepareImage preheats an image so that all required packages are installed
 func (p *Provider) PrepareImage(ctx context.Context, opts interfaces.PrepareOptions) error {
-	id := fmt.Sprintf("%s-prepare", imageAliasName)
-	cloudInitPrepare, err := common.GetCloudInitPrepare(ctx, opts.CustomCloudInitOverlay)
+	id := fmt.Sprintf("%s-prepare", p.imageAlias)
+	cloudInitPrepare, err := CloudInitPrepare(ctx, opts)
 	if err != nil {
 		return fmt.Errorf("get cloud init prepare: %w", err)
 	}
@@ -83,7 +189,7 @@ func (p *Provider) PrepareImage(ctx context.Context, opts interfaces.PrepareOpti
 	if err != nil {
 		return fmt.Errorf("creating container: %w", err)
 	}
-	err = createOp.Wait()
+	err = waitOperation(ctx, "createInstance", id, createOp)
 	if err != nil {
 		return fmt.Errorf("waiting for container creation: %w", err)
 	}
@@ -92,22 +198,15 @@ func (p *Provider) PrepareImage(ctx context.Context, opts interfaces.PrepareOpti
 	if err != nil {
 		return fmt.Errorf("starting container: %w", err)
 	}
-	err = startOp.Wait()
+	err = waitOperation(ctx, "startInstance", id, startOp)
 	if err != nil {
 		return fmt.Errorf("waiting for container start: %w", err)
 	}
 
 	// Wait for the container to shutdown
-	for {
-		instance, _, err := p.client.GetInstance(id)
-		if err != nil {
-			return fmt.Errorf("getting container status: %w", err)
-		}
-		if instance.StatusCode == api.Stopped {
-			break
-		}
-		// Add a small delay to avoid hammering the API
-		time.Sleep(1 * time.Second)
+	err = p.waitStopped(ctx, id)
+	if err != nil {
+		return err
 	}
 
 	// Create a new image from the container
@@ -118,12 +217,15 @@ func (p *Provider) PrepareImage(ctx context.Context, opts interfaces.PrepareOpti
 		},
 		ImagePut: api.ImagePut{
 			ExpiresAt: time.Now().Add(time.Hour * 24 * 7),
+			Properties: map[string]string{
+				imagePoolProperty: p.pool,
+			},
 		},
 	}, nil)
 	if err != nil {
 		return fmt.Errorf("creating image: %w", err)
 	}
-	err = imageCreateOp.Wait()
+	err = waitOperation(ctx, "createImage", id, imageCreateOp)
 	if err != nil {
 		return fmt.Errorf("waiting for image creation: %w", err)
 	}
@@ -140,7 +242,7 @@ func (p *Provider) PrepareImage(ctx context.Context, opts interfaces.PrepareOpti
 	fingerprint := imageCreateOp.Get().Metadata["fingerprint"].(string)
 
 	// Try to get the existing alias first
-	alias, etag, err := p.client.GetImageAlias(imageAliasName)
+	alias, etag, err := p.client.GetImageAlias(p.imageAlias)
 	if err == nil {
 		// Alias exists, update it
 		err = p.client.UpdateImageAlias(alias.Name, api.ImageAliasesEntryPut{
@@ -151,7 +253,7 @@ func (p *Provider) PrepareImage(ctx context.Context, opts interfaces.PrepareOpti
 		// Alias doesn't exist, create it
 		err = p.client.CreateImageAlias(api.ImageAliasesPost{
 			ImageAliasesEntry: api.ImageAliasesEntry{
-				Name:        imageAliasName,
+				Name:        p.imageAlias,
 				Target:      fingerprint,
 				Description: "Pre-prepared Actions Runner image",
 			},
@@ -164,18 +266,45 @@ func (p *Provider) PrepareImage(ctx context.Context, opts interfaces.PrepareOpti
 	return nil
 }
 
-func (p *Provider) CreateRunner(ctx context.Context, url, token, labels string) error {
-	id := fmt.Sprintf("actions-runner-ephemeral-%s", lo.RandomString(5, lo.LettersCharset))
+// waitStopped waits for cloud-init to finish preparing and shutdown the
+// instance
+func (p *Provider) waitStopped(ctx context.Context, id string) (err error) {
+	_, span := tracer.Start(ctx, "lxd.waitStopped", trace.WithAttributes(attribute.String("instance", id)))
+	defer func() { tracing.End(span, err) }()
+	for {
+		instance, _, err := p.client.GetInstance(id)
+		if err != nil {
+			return fmt.Errorf("getting container status: %w", err)
+		}
+		if instance.StatusCode == api.Stopped {
+			return nil
+		}
+		// Add a small delay to avoid hammering the API
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (p *Provider) CreateRunner(ctx context.Context, url, token, labels string) (_ string, err error) {
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	id := fmt.Sprintf("%s-%s", p.imageAlias, lo.RandomString(5, lo.LettersCharset))
 	cloudInitConf := common.GetCloudInitStart(url, token, labels)
 	createOp, err := p.client.CreateInstance(api.InstancesPost{
 		Name: id,
 		Source: api.InstanceSource{
 			Type:  "image",
-			Alias: imageAliasName,
+			Alias: p.imageAlias,
 		},
 		InstancePut: api.InstancePut{
 			Config: map[string]string{
 				actionsRunnerEphemeralKey: "true",
+				runnerPoolKey:             p.pool,
+				runnerLabelsKey:           labels,
 				"security.nesting":        "true",
 				"user.vendor-data":        cloudInitConf,
 			},
@@ -185,67 +314,210 @@ func (p *Provider) CreateRunner(ctx context.Context, url, token, labels string)
 		Type: api.InstanceTypeContainer,
 	})
 	if err != nil {
-		return fmt.Errorf("creating container: %w", err)
+		return "", fmt.Errorf("creating container: %w", err)
 	}
-	err = createOp.Wait()
+	defer func() {
+		if err != nil {
+			p.removeFailedInstance(id, createOp)
+		}
+	}()
+	err = waitOperation(ctx, "createInstance", id, createOp)
 	if err != nil {
-		return fmt.Errorf("waiting for container creation: %w", err)
+		return "", fmt.Errorf("waiting for container creation: %w", err)
 	}
 	startOp, err := p.client.UpdateInstanceState(id, api.InstanceStatePut{Action: "start"}, "")
 	if err != nil {
-		return fmt.Errorf("starting container: %w", err)
+		return "", fmt.Errorf("starting container: %w", err)
 	}
-	err = startOp.Wait()
+	err = waitOperation(ctx, "startInstance", id, startOp)
 	if err != nil {
-		return fmt.Errorf("waiting for container start: %w", err)
+		return "", fmt.Errorf("waiting for container start: %w", err)
+	}
+	return id, nil
+}
+
+// removeFailedInstance deletes an instance which was created but not started
+// so that it doesn't count toward the maximum forever. It doesn't use the
+// context of CreateRunner since that may be why it failed.
+func (p *Provider) removeFailedInstance(id string, createOp lxd.Operation) {
+	ctx, cancel := context.WithTimeout(context.Background(), removeFailedInstanceTimeout)
+	defer cancel()
+	// creation continues when we stop waiting for it. There is nothing to
+	// remove if it failed.
+	err := waitOperation(ctx, "createInstance", id, createOp)
+	if err != nil {
+		return
+	}
+	instance, _, err := p.client.GetInstance(id)
+	if err != nil {
+		slog.Warn("error when removing instance which failed to start", "provider", "lxd", "pool", p.pool, "instance", id, "error", err)
+		return
+	}
+	var op lxd.Operation
+	if instance.StatusCode == api.Stopped {
+		op, err = p.client.DeleteInstance(id)
+	} else {
+		// ephemeral instances are removed when they stop
+		op, err = p.client.UpdateInstanceState(id, api.InstanceStatePut{Action: "stop", Force: true}, "")
+	}
+	if err == nil {
+		err = waitOperation(ctx, "deleteInstance", id, op)
+	}
+	if err != nil {
+		slog.Warn("error when removing instance which failed to start", "provider", "lxd", "pool", p.pool, "instance", id, "error", err)
 	}
-	return nil
 }
 
-// DeleteRunners deletes N runner instances. If wait is true, it waits for the deletion to complete.
+// DeleteRunners deletes N idle or starting runner instances. If wait is true, it waits for the deletion to complete.
 //
 // All we have to do is stop the runner since the instances are ephemeral
-func (p *Provider) DeleteRunners(ctx context.Context, count int, wait bool) error {
-	instances, err := p.client.GetInstancesWithFilter(api.InstanceTypeContainer, []string{fmt.Sprintf("config.%s=true", actionsRunnerEphemeralKey)})
+func (p *Provider) DeleteRunners(ctx context.Context, count int, wait bool) ([]string, error) {
+	instances, err := p.listInstances(ctx)
 	if err != nil {
-		return fmt.Errorf("getting instances: %w", err)
+		return nil, err
 	}
 
 	// Start stop operations for up to count instances
 	stopOps := make([]lxd.Operation, 0, count)
 	stopNames := make([]string, 0, count)
-	for i := 0; i < count && i < len(instances); i++ {
+	for _, instance := range instances {
+		if len(stopNames) >= count {
+			break
+		}
+		// never interrupt a running job. Skip instances we can't read the
+		// state of and stopped instances which are already going away too.
+		if instance.StatusCode != api.Running {
+			continue
+		}
+		state, _, err := p.readRunnerState(instance.Name)
+		if err != nil || state == "active" {
+			continue
+		}
 		// Stop the instance
-		stopOp, err := p.client.UpdateInstanceState(instances[i].Name, api.InstanceStatePut{Action: "stop"}, "")
+		stopOp, err := p.client.UpdateInstanceState(instance.Name, api.InstanceStatePut{Action: "stop"}, "")
 		if err != nil {
-			return fmt.Errorf("stop instance %s: %w", instances[i].Name, err)
+			return stopNames, fmt.Errorf("stop instance %s: %w", instance.Name, err)
 		}
 		stopOps = append(stopOps, stopOp)
-		stopNames = append(stopNames, instances[i].Name)
+		stopNames = append(stopNames, instance.Name)
 	}
 
 	// Wait for all stop operations to complete
 	if wait {
 		for i, op := range stopOps {
 			op.Get()
-			err = op.Wait()
+			err = waitOperation(ctx, "stopInstance", stopNames[i], op)
 			if err != nil {
-				return fmt.Errorf("waiting for instance stop %s: %w", stopNames[i], err)
+				return stopNames, fmt.Errorf("waiting for instance stop %s: %w", stopNames[i], err)
 			}
 		}
 	}
 
-	return nil
+	return stopNames, nil
+}
+
+// DeleteRunnersByID stops runner instances which removes them since they are
+// ephemeral. Instances are only force stopped with DeleteForce. If wait is
+// true, it waits for the deletion to complete.
+func (p *Provider) DeleteRunnersByID(ctx context.Context, ids []string, mode interfaces.DeleteMode, wait bool) ([]string, error) {
+	instances, err := p.listInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// never stop instances which aren't our runners
+	for _, id := range ids {
+		if !slices.ContainsFunc(instances, func(instance api.Instance) bool { return instance.Name == id }) {
+			return nil, fmt.Errorf("stop instance %s: %w", id, interfaces.ErrRunnerNotFound)
+		}
+	}
+	force := mode == interfaces.DeleteForce
+	var errs []error
+	stopOps := make([]lxd.Operation, 0, len(ids))
+	stopNames := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !force && !p.canStop(instances, id) {
+			continue
+		}
+		stopOp, err := p.client.UpdateInstanceState(id, api.InstanceStatePut{Action: "stop", Force: force}, "")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stop instance %s: %w", id, err))
+			continue
+		}
+		stopOps = append(stopOps, stopOp)
+		stopNames = append(stopNames, id)
+	}
+	if !wait {
+		return stopNames, errors.Join(errs...)
+	}
+
+	stopped := make([]string, 0, len(stopNames))
+	for i, op := range stopOps {
+		err := waitOperation(ctx, "stopInstance", stopNames[i], op)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("waiting for instance stop %s: %w", stopNames[i], err))
+			continue
+		}
+		stopped = append(stopped, stopNames[i])
+	}
+	return stopped, errors.Join(errs...)
+}
+
+// canStop checks that an instance isn't running a job right before it is
+// stopped. Stopped instances are already going away.
+func (p *Provider) canStop(instances []api.Instance, id string) bool {
+	i := slices.IndexFunc(instances, func(instance api.Instance) bool { return instance.Name == id })
+	if instances[i].StatusCode != api.Running {
+		return false
+	}
+	state, _, err := p.readRunnerState(id)
+	if err != nil {
+		slog.Warn("not stopping instance with unknown state", "provider", "lxd", "pool", p.pool, "instance", id, "error", err)
+		return false
+	}
+	return state != "active"
+}
+
+// readRunnerState reads the state and the time it was written by the runner
+// hooks. Instances which have not written a state yet are starting. Other
+// errors are returned so that a busy runner is never mistaken for a starting
+// one and reaped.
+func (p *Provider) readRunnerState(name string) (string, time.Time, error) {
+	contentReader, _, err := p.client.GetInstanceFile(name, runnerStatePath)
+	if api.StatusErrorCheck(err, http.StatusNotFound) {
+		return "starting", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("read runner state: %w", err)
+	}
+	defer contentReader.Close()
+	contentBytes, err := io.ReadAll(contentReader)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	// images prepared by older versions only write the state
+	fields := strings.Fields(string(contentBytes))
+	if len(fields) == 0 {
+		return "", time.Time{}, nil
+	}
+	changedAt := time.Time{}
+	if len(fields) > 1 {
+		unix, err := strconv.ParseInt(fields[1], 10, 64)
+		if err == nil {
+			changedAt = time.Unix(unix, 0)
+		}
+	}
+	return fields[0], changedAt, nil
 }
 
 type disposition struct {
 	startingCount int
 	idleCount     int
 	activeCount   int
+	stoppedCount  int
 }
 
 func (d disposition) TotalCount() int {
-	return d.activeCount + d.idleCount + d.startingCount
+	return d.activeCount + d.idleCount + d.startingCount + d.stoppedCount
 }
 func (d disposition) StartingCount() int {
 	return d.startingCount
@@ -257,26 +529,69 @@ func (d disposition) ActiveCount() int {
 	return d.activeCount
 }
 
+func (p *Provider) ListRunners(ctx context.Context) ([]interfaces.Runner, error) {
+	instances, err := p.listInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	runners := make([]interfaces.Runner, 0, len(instances))
+	for _, instance := range instances {
+		// instances created before labels were recorded don't have the key
+		var labels []string
+		if value := instance.Config[runnerLabelsKey]; value != "" {
+			labels = strings.Split(value, ",")
+		}
+		runner := interfaces.Runner{
+			ID:        instance.Name,
+			State:     interfaces.RunnerStateStarting,
+			CreatedAt: instance.CreatedAt,
+			Labels:    labels,
+			Metadata: map[string]string{
+				"status":   instance.Status,
+				"location": instance.Location,
+				"image":    instance.Config["volatile.base_image"],
+			},
+		}
+		if instance.StatusCode != api.Running {
+			runner.State = interfaces.RunnerStateStopped
+		} else {
+			state, changedAt, err := p.readRunnerState(instance.Name)
+			if err != nil {
+				slog.Warn("error when reading runner state", "provider", "lxd", "pool", p.pool, "instance", instance.Name, "error", err)
+			}
+			runner.LastStateChange = changedAt
+			switch {
+			case err != nil:
+				runner.State = interfaces.RunnerStateUnknown
+			case state == "active":
+				runner.State = interfaces.RunnerStateActive
+			case state == "idle":
+				runner.State = interfaces.RunnerStateIdle
+			}
+		}
+		runners = append(runners, runner)
+	}
+	return runners, nil
+}
+
 func (p *Provider) RunnerDisposition(ctx context.Context) (interfaces.RunnerDispositionMetrics, error) {
-	instances, err := p.client.GetInstancesWithFilter(api.InstanceTypeContainer, []string{fmt.Sprintf("config.%s=true", actionsRunnerEphemeralKey)})
+	instances, err := p.listInstances(ctx)
 	if err != nil {
-		return disposition{}, fmt.Errorf("getting instances: %w", err)
+		return disposition{}, err
 	}
 	res := disposition{}
 	for _, instance := range instances {
-		contentReader, _, err := p.client.GetInstanceFile(instance.Name, "/tmp/actions-runner-state")
-		if err != nil {
-			res.startingCount++
+		// stopped instances may still have the state of the last job
+		if instance.StatusCode != api.Running {
+			res.stoppedCount++
 			continue
 		}
-		defer contentReader.Close()
-		contentBytes, err := io.ReadAll(contentReader)
+		state, _, err := p.readRunnerState(instance.Name)
 		if err != nil {
-			fmt.Printf("error reading content from %s: %v\n", instance.Name, err)
-			continue
+			// the instance still counts toward the capacity limits
+			slog.Warn("error when reading runner state", "provider", "lxd", "pool", p.pool, "instance", instance.Name, "error", err)
 		}
-		content := strings.TrimSpace(string(contentBytes))
-		switch content {
+		switch state {
 		case "active":
 			res.activeCount++
 		case "idle":
@@ -287,3 +602,12 @@ func (p *Provider) RunnerDisposition(ctx context.Context) (interfaces.RunnerDisp
 	}
 	return res, nil
 }
+
+// waitOperation waits for op in a span so that slow LXD operations show up in
+// traces
+func waitOperation(ctx context.Context, name, instance string, op lxd.Operation) error {
+	_, span := tracer.Start(ctx, "lxd."+name, trace.WithAttributes(attribute.String("instance", instance)))
+	err := op.WaitContext(ctx)
+	tracing.End(span, err)
+	return err
+}
@@ -0,0 +1,123 @@
+package lxd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/canonical/lxd/shared/api"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/providertest"
+	"gopkg.in/stretchr/testify.v1/require"
+)
+
+func TestProvider(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) providertest.Harness {
+		server := newFakeServer()
+		p := &Provider{
+			client:     server,
+			pool:       interfaces.DefaultPool,
+			imageAlias: imageAliasName,
+		}
+		return providertest.Harness{
+			Provider: p,
+			AddImage: func(t *testing.T) {
+				server.addImage(p.imageAlias, map[string]string{imagePoolProperty: p.pool})
+			},
+			SetState: func(t *testing.T, id string, state interfaces.RunnerState) {
+				content := fmt.Sprintf("%s %d", state, time.Now().Unix())
+				require.NoError(t, server.writeFile(id, runnerStatePath, content))
+			},
+			AddUnmanaged: func(t *testing.T) []string {
+				server.addInstance("database", nil)
+				server.addInstance(imageAliasName+"-other-abcde", map[string]string{
+					actionsRunnerEphemeralKey: "true",
+					runnerPoolKey:             "other",
+				})
+				return []string{"database", imageAliasName + "-other-abcde"}
+			},
+			Exists: func(t *testing.T, id string) bool {
+				_, _, err := server.GetInstance(id)
+				return err == nil
+			},
+		}
+	})
+}
+
+func TestReadRunnerStateError(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeServer()
+	p := &Provider{client: server, pool: interfaces.DefaultPool, imageAlias: imageAliasName}
+	server.addImage(p.imageAlias, nil)
+	id, err := p.CreateRunner(ctx, "https://github.com/org/repo", "token", "self-hosted")
+	require.NoError(t, err)
+	require.NoError(t, server.writeFile(id, runnerStatePath, "active"))
+
+	// a transient error doesn't make an active runner look like it is
+	// starting but the instance still counts toward the capacity limits
+	server.fileErr = api.StatusErrorf(http.StatusInternalServerError, "database is locked")
+	runners, err := p.ListRunners(ctx)
+	require.NoError(t, err)
+	require.Len(t, runners, 1)
+	require.Equal(t, interfaces.RunnerStateUnknown, runners[0].State)
+	metrics, err := p.RunnerDisposition(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, metrics.StartingCount())
+	require.Equal(t, 1, metrics.TotalCount())
+	deleted, err := p.DeleteRunners(ctx, 1, true)
+	require.NoError(t, err)
+	require.Empty(t, deleted)
+	deleted, err = p.DeleteRunnersByID(ctx, []string{id}, interfaces.DeleteIfNotActive, true)
+	require.NoError(t, err)
+	require.Empty(t, deleted)
+
+	server.fileErr = nil
+	runners, err = p.ListRunners(ctx)
+	require.NoError(t, err)
+	require.Len(t, runners, 1)
+	require.Equal(t, interfaces.RunnerStateActive, runners[0].State)
+}
+
+func TestCreateRunnerCleanup(t *testing.T) {
+	server := newFakeServer()
+	p := &Provider{client: server, pool: interfaces.DefaultPool, imageAlias: imageAliasName}
+	server.addImage(p.imageAlias, nil)
+
+	server.startErr = api.StatusErrorf(http.StatusInternalServerError, "out of memory")
+	_, err := p.CreateRunner(context.Background(), "https://github.com/org/repo", "token", "self-hosted")
+	require.Error(t, err)
+	// the created instance doesn't count toward the maximum
+	require.Empty(t, server.instances)
+
+	// the instance is removed even if the request was canceled
+	server.startErr = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	server.onCreate = cancel
+	_, err = p.CreateRunner(ctx, "https://github.com/org/repo", "token", "self-hosted")
+	require.True(t, errors.Is(err, context.Canceled), "unexpected error %v", err)
+	require.Empty(t, server.instances)
+}
+
+func TestListRunnersLabels(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeServer()
+	p := &Provider{client: server, pool: interfaces.DefaultPool, imageAlias: imageAliasName}
+	server.addImage(p.imageAlias, nil)
+	id, err := p.CreateRunner(ctx, "https://github.com/org/repo", "token", "self-hosted,linux")
+	require.NoError(t, err)
+	server.addInstance(imageAliasName+"-abcde", map[string]string{actionsRunnerEphemeralKey: "true"})
+
+	runners, err := p.ListRunners(ctx)
+	require.NoError(t, err)
+	require.Len(t, runners, 2)
+	for _, runner := range runners {
+		if runner.ID == id {
+			require.Equal(t, []string{"self-hosted", "linux"}, runner.Labels)
+		} else {
+			require.Nil(t, runner.Labels)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+// Package providertest checks that a provider implements the
+// interfaces.Provider contract. Providers run it against a fake of their API
+// so that their behavior doesn't drift apart.
+package providertest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+	"gopkg.in/stretchr/testify.v1/require"
+)
+
+const (
+	testURL    = "https://github.com/org/repo"
+	testToken  = "token"
+	testLabels = "self-hosted,test"
+)
+
+// Harness is a provider with a backend the tests can control
+type Harness struct {
+	// Provider must have no runners or images
+	Provider interfaces.Provider
+	// AddImage adds a runner image without preparing it
+	AddImage func(t *testing.T)
+	// SetState changes the state a runner reports like the runner hooks do
+	SetState func(t *testing.T, id string, state interfaces.RunnerState)
+	// AddUnmanaged is optional. It adds instances which are not runners of
+	// the provider's pool, like other VMs or runners of another pool, and
+	// returns their IDs.
+	AddUnmanaged func(t *testing.T) []string
+	// Exists returns whether an instance added by AddUnmanaged still exists
+	Exists func(t *testing.T, id string) bool
+}
+
+// Run runs every conformance test. newHarness is called for each test so
+// that they start from an empty backend.
+func Run(t *testing.T, newHarness func(t *testing.T) Harness) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, h Harness)
+	}{
+		{"ImageCreatedAtWithoutImage", testImageCreatedAtWithoutImage},
+		{"ImageCreatedAt", testImageCreatedAt},
+		{"CreateRunner", testCreateRunner},
+		{"RunnerDisposition", testRunnerDisposition},
+		{"DeleteRunnersSkipsActive", testDeleteRunnersSkipsActive},
+		{"DeleteRunnersByID", testDeleteRunnersByID},
+		{"DeleteRunnersByIDSkipsActive", testDeleteRunnersByIDSkipsActive},
+		{"DeleteRunnersByIDOnlyOwnRunners", testDeleteRunnersByIDOnlyOwnRunners},
+		{"ContextCanceled", testContextCanceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newHarness(t))
+		})
+	}
+}
+
+func testImageCreatedAtWithoutImage(t *testing.T, h Harness) {
+	createdAt, err := h.Provider.ImageCreatedAt(context.Background())
+	require.NoError(t, err)
+	require.True(t, createdAt.IsZero(), "created at %s", createdAt)
+}
+
+func testImageCreatedAt(t *testing.T, h Harness) {
+	ctx := context.Background()
+	h.AddImage(t)
+	createdAt, err := h.Provider.ImageCreatedAt(ctx)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), createdAt, time.Hour)
+
+	images, err := h.Provider.ListImages(ctx)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	require.True(t, images[0].Current)
+}
+
+func testCreateRunner(t *testing.T, h Harness) {
+	ctx := context.Background()
+	h.AddImage(t)
+	id, err := h.Provider.CreateRunner(ctx, testURL, testToken, testLabels)
+	require.NoError(t, err)
+	require.NotEmpty(t, id)
+
+	metrics, err := h.Provider.RunnerDisposition(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, metrics.StartingCount())
+	require.Equal(t, 1, metrics.TotalCount())
+
+	runners, err := h.Provider.ListRunners(ctx)
+	require.NoError(t, err)
+	require.Len(t, runners, 1)
+	require.Equal(t, id, runners[0].ID)
+	require.Equal(t, interfaces.RunnerStateStarting, runners[0].State)
+	require.Equal(t, []string{"self-hosted", "test"}, runners[0].Labels)
+
+	second, err := h.Provider.CreateRunner(ctx, testURL, testToken, testLabels)
+	require.NoError(t, err)
+	require.NotEqual(t, id, second)
+}
+
+// createRunners creates a runner in each state
+func createRunners(t *testing.T, h Harness, states ...interfaces.RunnerState) []string {
+	var ids []string
+	for _, state := range states {
+		id, err := h.Provider.CreateRunner(context.Background(), testURL, testToken, testLabels)
+		require.NoError(t, err)
+		if state != interfaces.RunnerStateStarting {
+			h.SetState(t, id, state)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func runnerStates(t *testing.T, h Harness) map[string]interfaces.RunnerState {
+	runners, err := h.Provider.ListRunners(context.Background())
+	require.NoError(t, err)
+	states := make(map[string]interfaces.RunnerState)
+	for _, runner := range runners {
+		states[runner.ID] = runner.State
+	}
+	return states
+}
+
+func testRunnerDisposition(t *testing.T, h Harness) {
+	h.AddImage(t)
+	ids := createRunners(t, h,
+		interfaces.RunnerStateStarting,
+		interfaces.RunnerStateIdle,
+		interfaces.RunnerStateIdle,
+		interfaces.RunnerStateActive,
+	)
+
+	metrics, err := h.Provider.RunnerDisposition(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, metrics.StartingCount())
+	require.Equal(t, 2, metrics.IdleCount())
+	require.Equal(t, 1, metrics.ActiveCount())
+	require.Equal(t, 4, metrics.TotalCount())
+
+	require.Equal(t, map[string]interfaces.RunnerState{
+		ids[0]: interfaces.RunnerStateStarting,
+		ids[1]: interfaces.RunnerStateIdle,
+		ids[2]: interfaces.RunnerStateIdle,
+		ids[3]: interfaces.RunnerStateActive,
+	}, runnerStates(t, h))
+}
+
+func testDeleteRunnersSkipsActive(t *testing.T, h Harness) {
+	ctx := context.Background()
+	h.AddImage(t)
+	ids := createRunners(t, h,
+		interfaces.RunnerStateActive,
+		interfaces.RunnerStateActive,
+	)
+	deleted, err := h.Provider.DeleteRunners(ctx, 2, true)
+	require.NoError(t, err)
+	require.Empty(t, deleted)
+	require.Len(t, runnerStates(t, h), 2)
+
+	ids = append(ids, createRunners(t, h,
+		interfaces.RunnerStateIdle,
+		interfaces.RunnerStateStarting,
+	)...)
+	deleted, err = h.Provider.DeleteRunners(ctx, 3, true)
+	require.NoError(t, err)
+	require.ElementsMatch(t, ids[2:], deleted)
+	require.Equal(t, map[string]interfaces.RunnerState{
+		ids[0]: interfaces.RunnerStateActive,
+		ids[1]: interfaces.RunnerStateActive,
+	}, runnerStates(t, h))
+
+	metrics, err := h.Provider.RunnerDisposition(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, metrics.ActiveCount())
+	require.Equal(t, 2, metrics.TotalCount())
+}
+
+func testDeleteRunnersByID(t *testing.T, h Harness) {
+	ctx := context.Background()
+	h.AddImage(t)
+	ids := createRunners(t, h,
+		interfaces.RunnerStateActive,
+		interfaces.RunnerStateIdle,
+		interfaces.RunnerStateStarting,
+	)
+	deleted, err := h.Provider.DeleteRunnersByID(ctx, ids[:2], interfaces.DeleteForce, true)
+	require.NoError(t, err)
+	require.ElementsMatch(t, ids[:2], deleted)
+	require.Equal(t, map[string]interfaces.RunnerState{
+		ids[2]: interfaces.RunnerStateStarting,
+	}, runnerStates(t, h))
+
+	deleted, err = h.Provider.DeleteRunnersByID(ctx, ids[2:], interfaces.DeleteForce, true)
+	require.NoError(t, err)
+	require.Equal(t, ids[2:], deleted)
+	require.Empty(t, runnerStates(t, h))
+}
+
+func testDeleteRunnersByIDSkipsActive(t *testing.T, h Harness) {
+	ctx := context.Background()
+	h.AddImage(t)
+	ids := createRunners(t, h,
+		interfaces.RunnerStateIdle,
+		interfaces.RunnerStateStarting,
+		interfaces.RunnerStateIdle,
+	)
+	// the runner takes a job after the caller listed it as idle
+	h.SetState(t, ids[2], interfaces.RunnerStateActive)
+	deleted, err := h.Provider.DeleteRunnersByID(ctx, ids, interfaces.DeleteIfNotActive, true)
+	require.NoError(t, err)
+	require.ElementsMatch(t, ids[:2], deleted)
+	require.Equal(t, map[string]interfaces.RunnerState{
+		ids[2]: interfaces.RunnerStateActive,
+	}, runnerStates(t, h))
+}
+
+func testDeleteRunnersByIDOnlyOwnRunners(t *testing.T, h Harness) {
+	ctx := context.Background()
+	h.AddImage(t)
+	ids := createRunners(t, h, interfaces.RunnerStateIdle)
+	unmanaged := []string{"not-a-runner"}
+	if h.AddUnmanaged != nil {
+		unmanaged = h.AddUnmanaged(t)
+	}
+	for _, id := range unmanaged {
+		deleted, err := h.Provider.DeleteRunnersByID(ctx, []string{ids[0], id}, interfaces.DeleteForce, true)
+		require.Empty(t, deleted)
+		require.True(t, errors.Is(err, interfaces.ErrRunnerNotFound), "expected runner not found for %s, got %v", id, err)
+		if h.Exists != nil {
+			require.True(t, h.Exists(t, id), "%s was deleted", id)
+		}
+	}
+
+	// nothing is deleted when an ID is rejected
+	require.Equal(t, map[string]interfaces.RunnerState{
+		ids[0]: interfaces.RunnerStateIdle,
+	}, runnerStates(t, h))
+}
+
+func testContextCanceled(t *testing.T, h Harness) {
+	h.AddImage(t)
+	ids := createRunners(t, h, interfaces.RunnerStateIdle)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := h.Provider.ImageCreatedAt(ctx)
+	requireCanceled(t, err)
+	_, err = h.Provider.CreateRunner(ctx, testURL, testToken, testLabels)
+	requireCanceled(t, err)
+	_, err = h.Provider.ListRunners(ctx)
+	requireCanceled(t, err)
+	_, err = h.Provider.RunnerDisposition(ctx)
+	requireCanceled(t, err)
+	_, err = h.Provider.DeleteRunners(ctx, 1, true)
+	requireCanceled(t, err)
+	deleted, err := h.Provider.DeleteRunnersByID(ctx, ids, interfaces.DeleteForce, true)
+	requireCanceled(t, err)
+	require.Empty(t, deleted)
+
+	// nothing was created or deleted
+	require.Equal(t, map[string]interfaces.RunnerState{
+		ids[0]: interfaces.RunnerStateIdle,
+	}, runnerStates(t, h))
+}
+
+func requireCanceled(t *testing.T, err error) {
+	t.Helper()
+	require.True(t, errors.Is(err, context.Canceled), "expected context canceled, got %v", err)
+}
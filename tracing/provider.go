@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"context"
+	"time"
+
+	"github.com/gartnera/actions-runner-ephemeral-autoscaler/providers/interfaces"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var providerTracer = otel.Tracer("github.com/gartnera/actions-runner-ephemeral-autoscaler/providers")
+
+// provider wraps a provider with a span for every call
+type provider struct {
+	provider interfaces.Provider
+	attrs    []attribute.KeyValue
+}
+
+// WrapProvider instruments every call to p. name is the type of provider and
+// pool is the pool it belongs to.
+func WrapProvider(p interfaces.Provider, name, pool string) interfaces.Provider {
+	return &provider{
+		provider: p,
+		attrs: []attribute.KeyValue{
+			attribute.String("provider", name),
+			attribute.String("pool", pool),
+		},
+	}
+}
+
+func (p *provider) start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return providerTracer.Start(ctx, "provider."+name, trace.WithAttributes(append(attrs, p.attrs...)...))
+}
+
+func (p *provider) ImageCreatedAt(ctx context.Context) (time.Time, error) {
+	ctx, span := p.start(ctx, "ImageCreatedAt")
+	createdAt, err := p.provider.ImageCreatedAt(ctx)
+	End(span, err)
+	return createdAt, err
+}
+
+func (p *provider) PrepareImage(ctx context.Context, opts interfaces.PrepareOptions) error {
+	ctx, span := p.start(ctx, "PrepareImage")
+	err := p.provider.PrepareImage(ctx, opts)
+	End(span, err)
+	return err
+}
+
+func (p *provider) CreateRunner(ctx context.Context, url, token, labels string) (string, error) {
+	ctx, span := p.start(ctx, "CreateRunner", attribute.String("labels", labels))
+	id, err := p.provider.CreateRunner(ctx, url, token, labels)
+	span.SetAttributes(attribute.String("instance", id))
+	End(span, err)
+	return id, err
+}
+
+func (p *provider) DeleteRunners(ctx context.Context, count int, wait bool) ([]string, error) {
+	ctx, span := p.start(ctx, "DeleteRunners", attribute.Int("count", count), attribute.Bool("wait", wait))
+	ids, err := p.provider.DeleteRunners(ctx, count, wait)
+	span.SetAttributes(attribute.StringSlice("instances", ids))
+	End(span, err)
+	return ids, err
+}
+
+func (p *provider) DeleteRunnersByID(ctx context.Context, ids []string, mode interfaces.DeleteMode, wait bool) ([]string, error) {
+	ctx, span := p.start(ctx, "DeleteRunnersByID", attribute.StringSlice("instances", ids), attribute.Bool("force", mode == interfaces.DeleteForce), attribute.Bool("wait", wait))
+	deleted, err := p.provider.DeleteRunnersByID(ctx, ids, mode, wait)
+	span.SetAttributes(attribute.StringSlice("deleted", deleted))
+	End(span, err)
+	return deleted, err
+}
+
+func (p *provider) RunnerDisposition(ctx context.Context) (interfaces.RunnerDispositionMetrics, error) {
+	ctx, span := p.start(ctx, "RunnerDisposition")
+	metrics, err := p.provider.RunnerDisposition(ctx)
+	End(span, err)
+	return metrics, err
+}
+
+func (p *provider) ListImages(ctx context.Context) ([]interfaces.Image, error) {
+	ctx, span := p.start(ctx, "ListImages")
+	images, err := p.provider.ListImages(ctx)
+	End(span, err)
+	return images, err
+}
+
+func (p *provider) ListRunners(ctx context.Context) ([]interfaces.Runner, error) {
+	ctx, span := p.start(ctx, "ListRunners")
+	runners, err := p.provider.ListRunners(ctx)
+	span.SetAttributes(attribute.Int("runners", len(runners)))
+	End(span, err)
+	return runners, err
+}